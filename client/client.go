@@ -0,0 +1,242 @@
+// Package client is a Go client for the crypto-go API.
+//
+//	c := client.New("https://alerts.example.com")
+//	if err := c.Login(ctx, "me@example.com", "secret"); err != nil {
+//		...
+//	}
+//	it := c.Subscriptions(ctx, &client.ListOptions{Token: "BTC"})
+//	for it.Next() {
+//		fmt.Println(it.Subscription().ID)
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+//
+// Tokens expire after an hour; long running programs call Refresh before
+// then.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// apiPrefix is the version of the API the client speaks
+const apiPrefix = "/v1"
+
+// Client calls the API at a base URL. It is safe for concurrent use.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+
+	maxRetries int
+	backoff    time.Duration
+
+	mu    sync.RWMutex
+	token string
+}
+
+// Option configures a Client
+type Option func(*Client)
+
+// WithHTTPClient sends the requests with hc instead of http.DefaultClient
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.httpClient = hc }
+}
+
+// WithToken authenticates the requests with a token obtained earlier
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// WithRetries retries a failed request up to n times, waiting backoff before
+// the first retry and twice as long before each following one. Requests are
+// retried on network errors, 502, 503 and 504 when they are idempotent and on
+// 429 after the delay asked for by the server. The default is 3 retries
+// starting at 250ms; n = 0 disables retries.
+func WithRetries(n int, backoff time.Duration) Option {
+	return func(c *Client) {
+		c.maxRetries = n
+		c.backoff = backoff
+	}
+}
+
+// New returns a client for the API at baseURL, e.g. "https://alerts.example.com"
+func New(baseURL string, opts ...Option) *Client {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		// keep the error for the first request rather than panicking
+		u = &url.URL{Opaque: baseURL}
+	}
+
+	c := &Client{
+		baseURL:    u,
+		httpClient: http.DefaultClient,
+		maxRetries: 3,
+		backoff:    250 * time.Millisecond,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	return c
+}
+
+// Token returns the token the requests are authenticated with
+func (c *Client) Token() string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return c.token
+}
+
+// SetToken authenticates the following requests with token
+func (c *Client) SetToken(token string) {
+	c.mu.Lock()
+	c.token = token
+	c.mu.Unlock()
+}
+
+// do sends a request to path, relative to the API version unless it is an
+// absolute path from a Link header, and decodes the JSON response into out.
+// It returns the response headers.
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) (http.Header, error) {
+	var body []byte
+	if in != nil {
+		var err error
+		if body, err = json.Marshal(in); err != nil {
+			return nil, err
+		}
+	}
+
+	if !strings.HasPrefix(path, apiPrefix+"/") {
+		path = apiPrefix + path
+	}
+	ref, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	target := c.baseURL.ResolveReference(ref)
+	target.Path = strings.TrimSuffix(c.baseURL.Path, "/") + ref.Path
+
+	wait := c.backoff
+	for attempt := 0; ; attempt++ {
+		header, err := c.send(ctx, method, target.String(), body, out)
+		if err == nil {
+			return header, nil
+		}
+
+		delay, retry := c.retryable(method, err, wait)
+		if !retry || attempt >= c.maxRetries {
+			return header, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return header, ctx.Err()
+		case <-time.After(delay):
+		}
+		wait *= 2
+	}
+}
+
+// send makes a single attempt of a request
+func (c *Client) send(ctx context.Context, method, target string, body []byte, out interface{}) (http.Header, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, target, reader)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if token := c.Token(); token != "" {
+		req.Header.Set("authorization", token)
+	}
+
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 400 {
+		return res.Header, decodeError(res)
+	}
+
+	if out != nil {
+		if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+			return res.Header, err
+		}
+	}
+	return res.Header, nil
+}
+
+// retryable reports whether a request that failed with err is sent again
+// and after how long
+func (c *Client) retryable(method string, err error, wait time.Duration) (time.Duration, bool) {
+	apiErr, ok := err.(*Error)
+	if !ok {
+		// the context ending is final, other transport errors are not
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return 0, false
+		}
+		return wait, idempotent(method)
+	}
+
+	switch apiErr.StatusCode {
+	case http.StatusTooManyRequests:
+		// the request was not processed, so any method can be retried
+		if apiErr.RetryAfter > 0 {
+			return apiErr.RetryAfter, true
+		}
+		return wait, true
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return wait, idempotent(method)
+	}
+	return 0, false
+}
+
+func idempotent(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
+// nextLink returns the target of the rel="next" Link header, if any
+func nextLink(header http.Header) string {
+	for _, v := range header.Values("Link") {
+		for _, link := range strings.Split(v, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			for _, p := range parts[1:] {
+				if strings.TrimSpace(p) == `rel="next"` {
+					return target
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// setInt sets key in v unless n is zero
+func setInt(v url.Values, key string, n int) {
+	if n != 0 {
+		v.Set(key, strconv.Itoa(n))
+	}
+}
@@ -0,0 +1,152 @@
+package client_test
+
+import (
+	"context"
+	"crypto-go/client"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Test logging in, refreshing the token and sending it with requests
+func TestLoginAndRefresh(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/users/login", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"email": "test@email.com", "token": "token-1"})
+	})
+	mux.HandleFunc("POST /v1/users/refresh", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("authorization") != "token-1" {
+			http.Error(w, "Invalid Token", 401)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"email": "test@email.com", "token": "token-2"})
+	})
+	mux.HandleFunc("GET /v1/users/me", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("authorization") != "token-2" {
+			http.Error(w, "Invalid Token", 401)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"email": "test@email.com"})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	ctx := context.Background()
+	c := client.New(srv.URL)
+
+	if _, err := c.Profile(ctx); !errors.Is(err, client.ErrUnauthorized) {
+		t.Errorf("Expected an unauthorized error. Got '%v'", err)
+	}
+
+	if err := c.Login(ctx, "test@email.com", "mysecurepassword123"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := c.Profile(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Email != "test@email.com" {
+		t.Errorf("Expected the profile of test@email.com. Got '%s'", u.Email)
+	}
+}
+
+// Test decoding error responses
+func TestErrors(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Request-ID", "req-1")
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"Subscription not found"}`))
+	}))
+	defer srv.Close()
+
+	_, err := client.New(srv.URL).GetSubscription(context.Background(), 7)
+
+	var apiErr *client.Error
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("Expected an *Error. Got '%v'", err)
+	}
+	if apiErr.StatusCode != 404 || apiErr.Message != "Subscription not found" || apiErr.RequestID != "req-1" {
+		t.Errorf("Expected the decoded 404. Got '%+v'", apiErr)
+	}
+	if !errors.Is(err, client.ErrNotFound) {
+		t.Error("Expected the error to match ErrNotFound")
+	}
+}
+
+// Test retrying rate limited and unavailable requests
+func TestRetries(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		switch calls {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			http.Error(w, `{"error":"Rate limit exceeded"}`, http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"id": 3, "token": "BTC"})
+		}
+	}))
+	defer srv.Close()
+
+	c := client.New(srv.URL, client.WithRetries(2, time.Millisecond))
+	s, err := c.GetSubscription(context.Background(), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.ID != 3 || calls != 3 {
+		t.Errorf("Expected subscription 3 after 3 calls. Got %d after %d", s.ID, calls)
+	}
+
+	// a create failing with 503 may have been processed, so it is not retried
+	calls = 1
+	if _, err := c.CreateSubscription(context.Background(), &client.Subscription{Token: "BTC"}); err == nil || calls != 2 {
+		t.Errorf("Expected a single failed attempt. Got %d attempts and '%v'", calls-1, err)
+	}
+}
+
+// Test iterating over the pages of subscriptions
+func TestSubscriptionsIterator(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("token") != "BTC" || r.URL.Query().Get("count") != "2" {
+			http.Error(w, `{"error":"lost the filters"}`, http.StatusBadRequest)
+			return
+		}
+
+		start, _ := strconv.Atoi(r.URL.Query().Get("cursor"))
+		subs := []client.Subscription{}
+		for id := start + 1; id <= start+2 && id <= 5; id++ {
+			subs = append(subs, client.Subscription{ID: id, Token: "BTC"})
+		}
+		if start+2 < 5 {
+			w.Header().Set("Link", fmt.Sprintf(`</v1/subscriptions?count=2&cursor=%d&token=BTC>; rel="next"`, start+2))
+		}
+		w.Header().Set("X-Total-Count", "5")
+		json.NewEncoder(w).Encode(subs)
+	}))
+	defer srv.Close()
+
+	it := client.New(srv.URL).Subscriptions(context.Background(), &client.ListOptions{PageSize: 2, Token: "BTC"})
+	ids := []int{}
+	for it.Next() {
+		ids = append(ids, it.Subscription().ID)
+	}
+	if err := it.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(ids) != "[1 2 3 4 5]" || it.Total() != 5 {
+		t.Errorf("Expected subscriptions 1 to 5. Got %v of %d", ids, it.Total())
+	}
+}
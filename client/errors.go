@@ -0,0 +1,77 @@
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// errors matched by errors.Is against an *Error of the same status
+var (
+	ErrBadRequest   = errors.New("bad request")
+	ErrUnauthorized = errors.New("unauthorized")
+	ErrForbidden    = errors.New("forbidden")
+	ErrNotFound     = errors.New("not found")
+	ErrConflict     = errors.New("conflict")
+	ErrRateLimited  = errors.New("rate limited")
+)
+
+var statusErrors = map[int]error{
+	http.StatusBadRequest:      ErrBadRequest,
+	http.StatusUnauthorized:    ErrUnauthorized,
+	http.StatusForbidden:       ErrForbidden,
+	http.StatusNotFound:        ErrNotFound,
+	http.StatusConflict:        ErrConflict,
+	http.StatusTooManyRequests: ErrRateLimited,
+}
+
+// Error is an error response of the API
+type Error struct {
+	StatusCode int
+	// Message is the error reported by the server
+	Message string
+	// RequestID identifies the request in the server logs
+	RequestID string
+	// RetryAfter is how long to wait before retrying a rate limited request
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return "crypto-go: " + http.StatusText(e.StatusCode)
+	}
+	return "crypto-go: " + strconv.Itoa(e.StatusCode) + " " + e.Message
+}
+
+// Is lets errors.Is(err, ErrNotFound) and the like match on the status code
+func (e *Error) Is(target error) bool {
+	return statusErrors[e.StatusCode] == target
+}
+
+// maxErrorBody bounds the error body read from the server
+const maxErrorBody = 64 << 10
+
+// decodeError reads the error of a response, which is JSON such as
+// {"error": "..."} or plain text for authentication errors
+func decodeError(res *http.Response) error {
+	e := &Error{StatusCode: res.StatusCode, RequestID: res.Header.Get("X-Request-ID")}
+	if s, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(s) * time.Second
+	}
+
+	body, _ := io.ReadAll(io.LimitReader(res.Body, maxErrorBody))
+	var payload struct {
+		Error string `json:"error"`
+	}
+	if json.Unmarshal(body, &payload) == nil && payload.Error != "" {
+		e.Message = payload.Error
+	} else {
+		e.Message = strings.TrimSpace(string(body))
+	}
+
+	return e
+}
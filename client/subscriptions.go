@@ -0,0 +1,222 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Subscription is a price alert of the authenticated user
+type Subscription struct {
+	ID           int     `json:"id,omitempty"`
+	Token        string  `json:"token"`
+	Quote        string  `json:"quote,omitempty"`
+	Percent      float64 `json:"percent"`
+	Window       string  `json:"window,omitempty"`
+	MinVal       float64 `json:"minVal"`
+	MaxVal       float64 `json:"maxVal"`
+	MinMaxChange float64 `json:"minMaxChange"`
+	Condition    string  `json:"condition,omitempty"`
+	Cooldown     int     `json:"cooldown,omitempty"`
+	Active       bool    `json:"active"`
+}
+
+// Event is an alert fired by a subscription
+type Event struct {
+	ID             int64      `json:"id"`
+	SubscriptionID int        `json:"subscriptionId"`
+	Token          string     `json:"token"`
+	Quote          string     `json:"quote"`
+	Rule           string     `json:"rule"`
+	Price          float64    `json:"price"`
+	Baseline       float64    `json:"baseline"`
+	Message        string     `json:"message"`
+	Channel        string     `json:"channel"`
+	Status         string     `json:"status"`
+	Error          string     `json:"error,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	DeliveredAt    *time.Time `json:"deliveredAt,omitempty"`
+}
+
+// ListOptions filters and sorts the subscriptions returned by Subscriptions
+type ListOptions struct {
+	// PageSize is the number of subscriptions fetched per request, up to 100
+	PageSize int
+	// Sort is a field such as "token", or "-token" for descending order
+	Sort   string
+	Token  string
+	Quote  string
+	Active *bool
+}
+
+func (o *ListOptions) values() url.Values {
+	v := url.Values{}
+	if o == nil {
+		return v
+	}
+
+	setInt(v, "count", o.PageSize)
+	if o.Sort != "" {
+		v.Set("sort", o.Sort)
+	}
+	if o.Token != "" {
+		v.Set("token", o.Token)
+	}
+	if o.Quote != "" {
+		v.Set("quote", o.Quote)
+	}
+	if o.Active != nil {
+		v.Set("active", strconv.FormatBool(*o.Active))
+	}
+	return v
+}
+
+// GetSubscription returns the subscription with id
+func (c *Client) GetSubscription(ctx context.Context, id int) (*Subscription, error) {
+	var s Subscription
+	if _, err := c.do(ctx, http.MethodGet, "/subscriptions/"+strconv.Itoa(id), nil, &s); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// CreateSubscription creates s and returns it with its id
+func (c *Client) CreateSubscription(ctx context.Context, s *Subscription) (*Subscription, error) {
+	var created Subscription
+	if _, err := c.do(ctx, http.MethodPost, "/subscriptions", s, &created); err != nil {
+		return nil, err
+	}
+	return &created, nil
+}
+
+// UpdateSubscription saves s, identified by its ID
+func (c *Client) UpdateSubscription(ctx context.Context, s *Subscription) (*Subscription, error) {
+	var updated Subscription
+	if _, err := c.do(ctx, http.MethodPut, "/subscriptions/"+strconv.Itoa(s.ID), s, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
+
+// DeleteSubscription deletes the subscription with id
+func (c *Client) DeleteSubscription(ctx context.Context, id int) error {
+	_, err := c.do(ctx, http.MethodDelete, "/subscriptions/"+strconv.Itoa(id), nil, nil)
+	return err
+}
+
+// Subscriptions iterates over the subscriptions matching opts, fetching
+// them a page at a time
+func (c *Client) Subscriptions(ctx context.Context, opts *ListOptions) *SubscriptionIterator {
+	return &SubscriptionIterator{p: pager{c: c, ctx: ctx, next: "/subscriptions?" + opts.values().Encode()}}
+}
+
+// Events iterates over the alert events of the authenticated user, newest
+// first. With subscriptionID set only the events of that subscription are
+// returned.
+func (c *Client) Events(ctx context.Context, subscriptionID int) *EventIterator {
+	path := "/events"
+	if subscriptionID != 0 {
+		path = "/subscriptions/" + strconv.Itoa(subscriptionID) + "/events"
+	}
+	return &EventIterator{p: pager{c: c, ctx: ctx, next: path}}
+}
+
+// SubscriptionIterator walks the pages of a subscription listing
+type SubscriptionIterator struct {
+	p    pager
+	page []Subscription
+	cur  Subscription
+}
+
+// Next advances to the next subscription, fetching a page when needed. It
+// returns false when there are no more subscriptions or a request failed.
+func (it *SubscriptionIterator) Next() bool {
+	for len(it.page) == 0 {
+		if !it.p.fetch(&it.page) {
+			return false
+		}
+	}
+	it.cur, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Subscription returns the current subscription
+func (it *SubscriptionIterator) Subscription() *Subscription {
+	return &it.cur
+}
+
+// Total returns the number of subscriptions matching the listing, known
+// once the first page is fetched
+func (it *SubscriptionIterator) Total() int {
+	return it.p.total
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *SubscriptionIterator) Err() error {
+	return it.p.err
+}
+
+// EventIterator walks the pages of an event listing
+type EventIterator struct {
+	p    pager
+	page []Event
+	cur  Event
+}
+
+// Next advances to the next event, fetching a page when needed. It returns
+// false when there are no more events or a request failed.
+func (it *EventIterator) Next() bool {
+	for len(it.page) == 0 {
+		if !it.p.fetch(&it.page) {
+			return false
+		}
+	}
+	it.cur, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Event returns the current event
+func (it *EventIterator) Event() *Event {
+	return &it.cur
+}
+
+// Err returns the error that stopped the iteration, if any
+func (it *EventIterator) Err() error {
+	return it.p.err
+}
+
+// pager follows the rel="next" links of a paginated listing
+type pager struct {
+	c     *Client
+	ctx   context.Context
+	next  string
+	total int
+	err   error
+}
+
+// fetch decodes the next page into page. It returns false once the last
+// page was fetched or a request failed.
+func (p *pager) fetch(page interface{}) bool {
+	if p.next == "" || p.err != nil {
+		return false
+	}
+
+	var raw json.RawMessage
+	header, err := p.c.do(p.ctx, http.MethodGet, p.next, nil, &raw)
+	if err == nil {
+		err = json.Unmarshal(raw, page)
+	}
+	if err != nil {
+		p.err = err
+		return false
+	}
+
+	if n, err := strconv.Atoi(header.Get("X-Total-Count")); err == nil {
+		p.total = n
+	}
+	p.next = nextLink(header)
+	return true
+}
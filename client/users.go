@@ -0,0 +1,79 @@
+package client
+
+import (
+	"context"
+	"net/http"
+)
+
+// User is an account of the API
+type User struct {
+	ID         int    `json:"id"`
+	Email      string `json:"email"`
+	Number     string `json:"number,omitempty"`
+	Timezone   string `json:"timezone,omitempty"`
+	QuietStart string `json:"quietStart,omitempty"`
+	QuietEnd   string `json:"quietEnd,omitempty"`
+	Digest     string `json:"digest,omitempty"`
+}
+
+type credentials struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+type tokenResponse struct {
+	Email string `json:"email"`
+	Token string `json:"token"`
+}
+
+// Register creates an account
+func (c *Client) Register(ctx context.Context, email, password string) (*User, error) {
+	var u User
+	if _, err := c.do(ctx, http.MethodPost, "/users/register", credentials{email, password}, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// Login authenticates the client as email. The token is used for the
+// following requests.
+func (c *Client) Login(ctx context.Context, email, password string) error {
+	var res tokenResponse
+	if _, err := c.do(ctx, http.MethodPost, "/users/login", credentials{email, password}, &res); err != nil {
+		return err
+	}
+
+	c.SetToken(res.Token)
+	return nil
+}
+
+// Refresh replaces the token of the client, which must still be valid, with
+// a new one
+func (c *Client) Refresh(ctx context.Context) error {
+	var res tokenResponse
+	if _, err := c.do(ctx, http.MethodPost, "/users/refresh", nil, &res); err != nil {
+		return err
+	}
+
+	c.SetToken(res.Token)
+	return nil
+}
+
+// Profile returns the authenticated user
+func (c *Client) Profile(ctx context.Context) (*User, error) {
+	var u User
+	if _, err := c.do(ctx, http.MethodGet, "/users/me", nil, &u); err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// UpdateProfile saves the phone number, timezone, quiet hours and digest mode
+// of the authenticated user and returns the updated profile
+func (c *Client) UpdateProfile(ctx context.Context, u *User) (*User, error) {
+	var updated User
+	if _, err := c.do(ctx, http.MethodPut, "/users/me", u, &updated); err != nil {
+		return nil, err
+	}
+	return &updated, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// alert rules a subscription can trigger
+const (
+	rulePercent = "percent"
+	ruleMin     = "min"
+	ruleMax     = "max"
+	ruleCond    = "condition"
+)
+
+// evaluate checks the subscription against the current price of its pair
+// and the baseline (the price when it was last evaluated or fired). It
+// returns the rule that fired, or "" if none did. Min and max thresholds
+// only fire when the price crosses them. Percent changes over a rolling
+// window are checked by the watcher against the price history instead.
+func (s *sub) evaluate(price, baseline float64) string {
+	if s.MinVal > 0 && price <= s.MinVal && baseline > s.MinVal {
+		return ruleMin
+	}
+	if s.MaxVal > 0 && price >= s.MaxVal && baseline < s.MaxVal {
+		return ruleMax
+	}
+	if s.Percent > 0 && s.Window == "" && baseline > 0 && math.Abs(percentChange(baseline, price)) >= s.Percent {
+		return rulePercent
+	}
+	return ""
+}
+
+// threshold returns the setting of s that rule fired on: the min or max
+// price, the percent change, or 0 for a condition
+func (s *sub) threshold(rule string) float64 {
+	switch rule {
+	case ruleMin:
+		return s.MinVal
+	case ruleMax:
+		return s.MaxVal
+	case rulePercent:
+		return s.Percent
+	default:
+		return 0
+	}
+}
+
+// percentChange returns the change from baseline to price in percent
+func percentChange(baseline, price float64) float64 {
+	return (price - baseline) / baseline * 100
+}
+
+// message builds the notification text for a fired rule
+func (s *sub) message(rule string, price, baseline float64) string {
+	pair := pricePair(s.Token, s.Quote)
+	now := formatPrice(price, s.Quote)
+
+	switch rule {
+	case ruleCond:
+		if price == 0 {
+			return fmt.Sprintf("Your condition %q is met", s.Condition)
+		}
+		return fmt.Sprintf("Your condition %q is met, %s is %s", s.Condition, pair, now)
+	case ruleMin:
+		return fmt.Sprintf("%s fell to %s, below your minimum of %s", pair, now, formatPrice(s.MinVal, s.Quote))
+	case ruleMax:
+		return fmt.Sprintf("%s rose to %s, above your maximum of %s", pair, now, formatPrice(s.MaxVal, s.Quote))
+	default:
+		if s.Window != "" {
+			return fmt.Sprintf("%s is %s, %+.2f%% over %s", pair, now, percentChange(baseline, price), s.Window)
+		}
+		return fmt.Sprintf("%s is %s, %+.2f%% since %s", pair, now, percentChange(baseline, price), formatPrice(baseline, s.Quote))
+	}
+}
+
+// roundEnv evaluates conditions against the prices of one polling round and
+// the stored history
+type roundEnv struct {
+	db   dbtx
+	book quoteBook
+	now  time.Time
+}
+
+func (e roundEnv) price(token, quote string) (float64, error) {
+	p, ok := e.book.rate(token, quote)
+	if !ok {
+		return 0, fmt.Errorf("no price for %s", pricePair(token, quote))
+	}
+	return p, nil
+}
+
+func (e roundEnv) change(token, quote string, window time.Duration) (float64, error) {
+	now, err := e.price(token, quote)
+	if err != nil {
+		return 0, err
+	}
+
+	then, err := priceAt(e.db, token, quote, e.now.Add(-window), historyTolerance(window))
+	if err != nil {
+		return 0, fmt.Errorf("%s %s ago: %v", pricePair(token, quote), window, err)
+	}
+
+	return percentChange(then, now), nil
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
+	"log/slog"
 	"net/http"
-	"strings"
+	"sync"
 
 	"github.com/gorilla/mux"
 	"github.com/justinas/alice"
@@ -16,6 +18,24 @@ import (
 type App struct {
 	Router *mux.Router
 	DB     *sql.DB
+
+	// Admins lists the emails of the users allowed to use the /admin routes
+	Admins []string
+
+	// RateLimits limits the requests per client of each route group: auth,
+	// api and stream. Groups without a limit are not throttled.
+	RateLimits map[string]RateLimit
+
+	// CORS lists the other origins allowed to call the API from a browser
+	CORS CORS
+
+	hub        *hub
+	metrics    *metrics
+	watcher    *watcher
+	dispatcher *dispatcher
+
+	// background tracks the goroutines started by Watch
+	background sync.WaitGroup
 }
 
 // Initialize Function to connect postgres driver
@@ -29,31 +49,192 @@ func (a *App) Initialize(user, dbname string) {
 		log.Fatal(err)
 	}
 
+	a.hub = newHub()
+	a.metrics = newMetrics(a.DB)
+
 	a.Router = mux.NewRouter()
 	a.initializeRoutes()
 }
 
-// Run runs the app
-func (a *App) Run(addr string) {
-	fmt.Printf("Server listening on port %s\n", strings.Trim(addr, ":"))
-	log.Fatal(http.ListenAndServe(addr, a.Router))
+// SeedAssets loads the asset catalog from a JSON file
+func (a *App) SeedAssets(path string) error {
+	n, err := seedAssets(a.DB, path)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("seeded assets", "count", n, "file", path)
+	return nil
+}
+
+// Watch starts polling prices and sending notifications in the background
+// until ctx is done
+func (a *App) Watch(ctx context.Context, cfg config) {
+	n := newNotifier(cfg)
+
+	a.watcher = newWatcher(a.DB, newCryptoCompare(), n, a.hub, a.metrics, cfg)
+	a.dispatcher = newDispatcher(a.DB, n, a.metrics, cfg)
+
+	a.background.Add(2)
+	go func() {
+		defer a.background.Done()
+		a.watcher.run(ctx)
+	}()
+	go func() {
+		defer a.background.Done()
+		a.dispatcher.run(ctx)
+	}()
+}
+
+// Run serves the app until ctx is done, then drains the in-flight requests,
+// waits for the background workers and closes the database. With a TLS
+// certificate configured it serves HTTPS, and optionally redirects plain
+// HTTP on RedirectPort.
+func (a *App) Run(ctx context.Context, cfg config) error {
+	srv := a.newServer(cfg.Port, a.Router, cfg)
+	// streams never finish by themselves, end them so Shutdown can return
+	srv.RegisterOnShutdown(func() { a.hub.closeAll("server shutting down") })
+	servers := []*http.Server{srv}
+
+	errs := make(chan error, 2)
+	if cfg.TLSCert == "" {
+		go func() {
+			slog.Info("server listening", "port", cfg.Port)
+			errs <- srv.ListenAndServe()
+		}()
+	} else {
+		certs, err := newCertReloader(cfg.TLSCert, cfg.TLSKey)
+		if err != nil {
+			return err
+		}
+		a.background.Add(1)
+		go func() {
+			defer a.background.Done()
+			certs.watch(ctx)
+		}()
+
+		srv.TLSConfig = newTLSConfig(certs.GetCertificate)
+		go func() {
+			slog.Info("server listening", "port", cfg.Port, "tls", true)
+			errs <- srv.ListenAndServeTLS("", "")
+		}()
+
+		if cfg.RedirectPort != "" {
+			redirect := a.newServer(cfg.RedirectPort, redirectToHTTPS(cfg.Port), cfg)
+			servers = append(servers, redirect)
+			go func() {
+				slog.Info("redirecting HTTP to HTTPS", "port", cfg.RedirectPort)
+				errs <- redirect.ListenAndServe()
+			}()
+		}
+	}
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("server shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+
+	var err error
+	for _, s := range servers {
+		if serr := s.Shutdown(shutdownCtx); err == nil {
+			err = serr
+		}
+	}
+	a.background.Wait()
+	if cerr := a.DB.Close(); err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// newServer returns a server for handler on port with the configured limits
+func (a *App) newServer(port string, handler http.Handler, cfg config) *http.Server {
+	return &http.Server{
+		Addr:           ":" + port,
+		Handler:        handler,
+		ReadTimeout:    cfg.ReadTimeout.Duration,
+		WriteTimeout:   cfg.WriteTimeout.Duration,
+		IdleTimeout:    cfg.IdleTimeout.Duration,
+		MaxHeaderBytes: cfg.MaxHeaderBytes,
+	}
 }
 
 func (a *App) initializeRoutes() {
 	// set up middleware using alice
-	commonHandlers := alice.New(loggingHandler, validateToken)
+	baseHandlers := alice.New(requestIDHandler, traceHandler, a.metrics.instrument, loggingHandler, a.cors)
+
+	// the limiters are shared by the versioned routes and their aliases
+	limiters := map[string]alice.Constructor{
+		limitAuth:   a.rateLimit(limitAuth, false),
+		limitAPI:    a.rateLimit(limitAPI, true),
+		limitStream: a.rateLimit(limitStream, false),
+	}
+
+	a.apiRoutes(a.Router.PathPrefix("/v1").Subrouter(), baseHandlers, limiters)
+
+	// unversioned aliases of /v1 for older clients
+	a.apiRoutes(a.Router, baseHandlers.Append(deprecatedRoute), limiters)
+
+	// monitoring routes
+	a.Router.Handle("/metrics", a.metrics.handler()).Methods("GET")
+	a.Router.HandleFunc("/healthz", a.healthz).Methods("GET")
+	a.Router.HandleFunc("/readyz", a.readyz).Methods("GET")
+
+	// documentation routes
+	a.Router.Handle("/openapi.json", baseHandlers.ThenFunc(a.getOpenAPI)).Methods("GET")
+	a.Router.Handle("/docs", baseHandlers.ThenFunc(a.getDocs)).Methods("GET")
+
+	// CORS preflight requests for any route, answered by the cors middleware
+	a.Router.PathPrefix("/").Handler(baseHandlers.ThenFunc(methodNotAllowed)).Methods("OPTIONS")
+}
+
+// apiRoutes registers the routes of the API on r
+func (a *App) apiRoutes(r *mux.Router, baseHandlers alice.Chain, limiters map[string]alice.Constructor) {
+	commonHandlers := baseHandlers.Append(validateToken, limiters[limitAPI])
+	authHandlers := baseHandlers.Append(limiters[limitAuth])
+	streamHandlers := baseHandlers.Append(limiters[limitStream])
 
 	// user routes
-	a.Router.Handle("/user", commonHandlers.ThenFunc(a.getUserByEmail)).Methods("POST")
-	a.Router.Handle("/users", commonHandlers.ThenFunc(a.getAllUsers)).Methods("GET")
-	a.Router.Handle("/users/register", alice.New(loggingHandler).ThenFunc(a.createUser)).Methods("POST")
-	a.Router.Handle("/users/login", alice.New(loggingHandler).ThenFunc(a.loginUser)).Methods("POST")
+	r.Handle("/users/me", commonHandlers.ThenFunc(a.getProfile)).Methods("GET")
+	r.Handle("/users/me", commonHandlers.ThenFunc(a.updateProfile)).Methods("PUT")
+	r.Handle("/users", commonHandlers.ThenFunc(a.getAllUsers)).Methods("GET")
+	r.Handle("/users/register", authHandlers.ThenFunc(a.createUser)).Methods("POST")
+	r.Handle("/users/login", authHandlers.ThenFunc(a.loginUser)).Methods("POST")
+	r.Handle("/users/refresh", commonHandlers.ThenFunc(a.refreshToken)).Methods("POST")
+
+	// asset routes
+	r.Handle("/assets", commonHandlers.ThenFunc(a.getAssets)).Methods("GET")
+	r.Handle("/assets/{symbol:[a-zA-Z]+}", commonHandlers.ThenFunc(a.getAsset)).Methods("GET")
+
+	// price routes
+	r.Handle("/prices/{token:[a-zA-Z]+}", commonHandlers.ThenFunc(a.getPrices)).Methods("GET")
 
 	// subscription routes
-	a.Router.Handle("/subscriptions", commonHandlers.ThenFunc(a.getAllSubs)).Methods("GET")
-	a.Router.Handle("/subscriptions", commonHandlers.ThenFunc(a.createSub)).Methods("POST")
-	a.Router.Handle("/subscriptions/{token:[a-zA-Z]+}", commonHandlers.ThenFunc(a.getSubByToken)).Methods("GET")
-	a.Router.Handle("/subscriptions/{id:[0-9]+}", commonHandlers.ThenFunc(a.getSub)).Methods("GET")
-	a.Router.Handle("/subscriptions/{id:[0-9]+}", commonHandlers.ThenFunc(a.updateSub)).Methods("PUT")
-	a.Router.Handle("/subscriptions/{id:[0-9]+}", commonHandlers.ThenFunc(a.deleteSub)).Methods("DELETE")
+	r.Handle("/subscriptions", commonHandlers.ThenFunc(a.getAllSubs)).Methods("GET")
+	r.Handle("/subscriptions", commonHandlers.ThenFunc(a.createSub)).Methods("POST")
+	r.Handle("/subscriptions/import", commonHandlers.ThenFunc(a.importSubs)).Methods("POST")
+	r.Handle("/subscriptions/export", commonHandlers.ThenFunc(a.exportSubs)).Methods("GET")
+	r.Handle("/subscriptions/{token:[a-zA-Z,]+}", commonHandlers.ThenFunc(a.getSubByToken)).Methods("GET")
+	r.Handle("/subscriptions/{id:[0-9]+}", commonHandlers.ThenFunc(a.getSub)).Methods("GET")
+	r.Handle("/subscriptions/{id:[0-9]+}", commonHandlers.ThenFunc(a.updateSub)).Methods("PUT")
+	r.Handle("/subscriptions/{id:[0-9]+}", commonHandlers.ThenFunc(a.deleteSub)).Methods("DELETE")
+	r.Handle("/subscriptions/{id:[0-9]+}/events", commonHandlers.ThenFunc(a.getSubEvents)).Methods("GET")
+
+	// alert event routes
+	r.Handle("/events", commonHandlers.ThenFunc(a.getEvents)).Methods("GET")
+	r.Handle("/events/stream", streamHandlers.ThenFunc(a.streamEvents)).Methods("GET")
+
+	// admin routes
+	adminHandlers := commonHandlers.Append(a.adminOnly)
+	r.Handle("/admin/deliveries", adminHandlers.ThenFunc(a.getDeliveries)).Methods("GET")
+	r.Handle("/admin/deliveries/{id:[0-9]+}/requeue", adminHandlers.ThenFunc(a.requeueDelivery)).Methods("POST")
+
+	// live streams, authenticated by their handlers since browsers pass the token as a query parameter
+	r.Handle("/ws", streamHandlers.ThenFunc(a.serveWS)).Methods("GET")
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+type asset struct {
+	Symbol   string   `json:"symbol"`
+	Name     string   `json:"name"`
+	Decimals int      `json:"decimals"`
+	Quotes   []string `json:"quotes"`
+	Enabled  bool     `json:"enabled"`
+}
+
+// validationError is returned for input that is well formed but not
+// acceptable, as opposed to errors talking to the database.
+type validationError string
+
+func (e validationError) Error() string {
+	return string(e)
+}
+
+func (as *asset) getAsset(db dbtx) error {
+	return db.QueryRow("SELECT symbol, name, decimals, quotes, enabled FROM assets WHERE symbol=$1",
+		normalizeToken(as.Symbol)).Scan(&as.Symbol, &as.Name, &as.Decimals, pq.Array(&as.Quotes), &as.Enabled)
+}
+
+// upsertAsset creates the asset or replaces the catalog entry with the same
+// symbol.
+func (as *asset) upsertAsset(db dbtx) error {
+	as.Symbol = normalizeToken(as.Symbol)
+	for i := range as.Quotes {
+		as.Quotes[i] = normalizeToken(as.Quotes[i])
+	}
+
+	_, err := db.Exec(
+		`INSERT INTO assets(symbol, name, decimals, quotes, enabled) VALUES($1, $2, $3, $4, $5)
+		ON CONFLICT (symbol) DO UPDATE SET name=EXCLUDED.name, decimals=EXCLUDED.decimals, quotes=EXCLUDED.quotes, enabled=EXCLUDED.enabled`,
+		as.Symbol, as.Name, as.Decimals, pq.Array(as.Quotes), as.Enabled)
+
+	return err
+}
+
+func getAssets(db dbtx, enabledOnly bool) ([]asset, error) {
+	rows, err := db.Query(
+		"SELECT symbol, name, decimals, quotes, enabled FROM assets WHERE enabled OR NOT $1 ORDER BY symbol",
+		enabledOnly)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	assets := []asset{}
+
+	for rows.Next() {
+		var as asset
+		if err := rows.Scan(&as.Symbol, &as.Name, &as.Decimals, pq.Array(&as.Quotes), &as.Enabled); err != nil {
+			return nil, err
+		}
+		assets = append(assets, as)
+	}
+
+	return assets, rows.Err()
+}
+
+// seedAssets upserts the assets listed in a JSON file in a single
+// transaction and returns how many were written.
+func seedAssets(db *sql.DB, path string) (int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	var assets []asset
+	if err := json.NewDecoder(f).Decode(&assets); err != nil {
+		return 0, fmt.Errorf("%s: %v", path, err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	for i := range assets {
+		if normalizeToken(assets[i].Symbol) == "" {
+			return 0, fmt.Errorf("%s: asset %d has no symbol", path, i+1)
+		}
+		if err := assets[i].upsertAsset(tx); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(assets), tx.Commit()
+}
+
+// supportsQuote reports whether prices of the asset may be quoted in quote
+func (as *asset) supportsQuote(quote string) bool {
+	for _, q := range as.Quotes {
+		if q == quote {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAsset verifies that the token of the subscription, and every token its
+// condition refers to, is an enabled asset in the catalog quoted in a
+// supported currency.
+func (s *sub) checkAsset(db dbtx) error {
+	quote := normalizeToken(s.Quote)
+	if quote == "" {
+		quote = defaultQuote
+	}
+
+	pairs := []condPair{{Token: normalizeToken(s.Token), Quote: quote}}
+	if strings.TrimSpace(s.Condition) != "" {
+		c, err := parseCondition(s.Condition)
+		if err != nil {
+			return validationError(err.Error())
+		}
+		pairs = append(pairs, c.symbols(quote)...)
+	}
+
+	for _, p := range pairs {
+		if err := checkPair(db, p.Token, p.Quote); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkPair verifies that token is an enabled asset quoted in quote
+func checkPair(db dbtx, token, quote string) error {
+	as := asset{Symbol: token}
+	if err := as.getAsset(db); err != nil {
+		if err == sql.ErrNoRows {
+			return validationError(fmt.Sprintf("unknown token %q", token))
+		}
+		return err
+	}
+
+	if !as.Enabled {
+		return validationError(fmt.Sprintf("token %q is not enabled", as.Symbol))
+	}
+
+	if !as.supportsQuote(quote) {
+		return validationError(fmt.Sprintf("unsupported pair %s/%s", as.Symbol, quote))
+	}
+
+	return nil
+}
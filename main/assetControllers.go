@@ -0,0 +1,40 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// GET the asset catalog, only enabled assets unless ?all=true
+func (a *App) getAssets(w http.ResponseWriter, r *http.Request) {
+	all, _ := strconv.ParseBool(r.FormValue("all"))
+
+	assets, err := getAssets(a.store(r), !all)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, assets)
+}
+
+// GET a single asset by symbol
+func (a *App) getAsset(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+
+	as := asset{Symbol: vars["symbol"]}
+	if err := as.getAsset(a.store(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Asset not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, as)
+}
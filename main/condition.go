@@ -0,0 +1,630 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// A condition is a boolean expression over prices evaluated each polling
+// round, for example
+//
+//	price(ETH) > 3000 AND change_24h(ETH) < -5%
+//	price(ETH) / price(BTC) < 0.05
+//	price(ETH, EUR) >= 2500 OR NOT change_1h(BTC) > -2%
+//
+// price(TOKEN[, QUOTE]) is the current price, quoted in the subscription's
+// currency unless QUOTE is given. change_1h, change_24h and change_7d return
+// the percent change over that window. Percentages are their own type: they
+// compare with percent literals such as -5%, not plain numbers.
+
+// conditionFuncs maps the change functions to their lookback window
+var conditionFuncs = map[string]time.Duration{
+	"change_1h":  lookbackWindows["1h"],
+	"change_24h": lookbackWindows["24h"],
+	"change_7d":  lookbackWindows["7d"],
+}
+
+// maxConditionLength bounds the source of a condition
+const maxConditionLength = 500
+
+// conditionError reports a syntax or type error at a position of the source
+type conditionError struct {
+	Pos int
+	Msg string
+}
+
+func (e *conditionError) Error() string {
+	return fmt.Sprintf("invalid condition at column %d: %s", e.Pos+1, e.Msg)
+}
+
+func condErrorf(pos int, format string, args ...interface{}) error {
+	return &conditionError{Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
+
+// condEnv supplies the price data a condition is evaluated against
+type condEnv interface {
+	price(token, quote string) (float64, error)
+	change(token, quote string, window time.Duration) (float64, error)
+}
+
+// condPair is a token/quote pair a condition reads; an empty quote means
+// the quote of the subscription
+type condPair struct {
+	Token string
+	Quote string
+}
+
+type condition struct {
+	src   string
+	root  condNode
+	pairs []condPair
+}
+
+// parseCondition parses and type checks src, which must be a boolean
+// expression.
+func parseCondition(src string) (*condition, error) {
+	if len(src) > maxConditionLength {
+		return nil, condErrorf(maxConditionLength, "longer than %d characters", maxConditionLength)
+	}
+
+	tokens, err := lexCondition(src)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &condParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != condEOF {
+		return nil, condErrorf(t.pos, "unexpected %q", t.text)
+	}
+
+	typ, err := typeCheck(root)
+	if err != nil {
+		return nil, err
+	}
+	if typ != condBool {
+		return nil, condErrorf(root.position(), "expression is a %s, not a true/false condition", typ)
+	}
+
+	return &condition{src: src, root: root, pairs: p.pairs}, nil
+}
+
+// eval evaluates the condition with quote as the default quote currency
+func (c *condition) eval(env condEnv, quote string) (bool, error) {
+	v, err := evalNode(c.root, env, quote)
+	return v.b, err
+}
+
+// symbols returns the tokens and quotes the condition refers to, resolving
+// the default quote to quote
+func (c *condition) symbols(quote string) []condPair {
+	pairs := make([]condPair, len(c.pairs))
+	for i, p := range c.pairs {
+		if p.Quote == "" {
+			p.Quote = quote
+		}
+		pairs[i] = p
+	}
+	return pairs
+}
+
+// lexer
+
+type condTokenKind int
+
+const (
+	condEOF condTokenKind = iota
+	condNumber
+	condIdent
+	condOp
+	condLParen
+	condRParen
+	condComma
+)
+
+type condToken struct {
+	kind condTokenKind
+	text string
+	pos  int
+}
+
+// condKeywords maps the spelled out and symbolic logical operators to one form
+var condKeywords = map[string]string{
+	"AND": "AND", "&&": "AND",
+	"OR": "OR", "||": "OR",
+	"NOT": "NOT", "!": "NOT",
+}
+
+func lexCondition(src string) ([]condToken, error) {
+	tokens := []condToken{}
+	i := 0
+
+	for i < len(src) {
+		c := rune(src[i])
+		switch {
+		case unicode.IsSpace(c):
+			i++
+		case unicode.IsDigit(c) || c == '.':
+			start := i
+			for i < len(src) && (unicode.IsDigit(rune(src[i])) || src[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, condToken{condNumber, src[start:i], start})
+		case unicode.IsLetter(c) || c == '_':
+			start := i
+			for i < len(src) && (unicode.IsLetter(rune(src[i])) || unicode.IsDigit(rune(src[i])) || src[i] == '_') {
+				i++
+			}
+			word := src[start:i]
+			if kw, ok := condKeywords[strings.ToUpper(word)]; ok {
+				tokens = append(tokens, condToken{condOp, kw, start})
+			} else {
+				tokens = append(tokens, condToken{condIdent, word, start})
+			}
+		case c == '(':
+			tokens = append(tokens, condToken{condLParen, "(", i})
+			i++
+		case c == ')':
+			tokens = append(tokens, condToken{condRParen, ")", i})
+			i++
+		case c == ',':
+			tokens = append(tokens, condToken{condComma, ",", i})
+			i++
+		default:
+			op := ""
+			for _, candidate := range []string{"<=", ">=", "==", "!=", "&&", "||", "<", ">", "=", "+", "-", "*", "/", "%", "!"} {
+				if strings.HasPrefix(src[i:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, condErrorf(i, "unexpected character %q", c)
+			}
+			start := i
+			i += len(op)
+			if kw, ok := condKeywords[op]; ok {
+				op = kw
+			} else if op == "=" {
+				op = "=="
+			}
+			tokens = append(tokens, condToken{condOp, op, start})
+		}
+	}
+
+	return append(tokens, condToken{condEOF, "end of condition", len(src)}), nil
+}
+
+// syntax tree
+
+type condType int
+
+const (
+	condNum condType = iota
+	condPercent
+	condBool
+)
+
+func (t condType) String() string {
+	switch t {
+	case condPercent:
+		return "percentage"
+	case condBool:
+		return "condition"
+	default:
+		return "number"
+	}
+}
+
+type condNode interface {
+	position() int
+}
+
+type condLiteral struct {
+	pos     int
+	value   float64
+	percent bool
+}
+
+type condCall struct {
+	pos   int
+	fn    string
+	token string
+	quote string
+}
+
+type condUnary struct {
+	pos int
+	op  string
+	x   condNode
+}
+
+type condBinary struct {
+	pos  int
+	op   string
+	x, y condNode
+}
+
+func (n *condLiteral) position() int { return n.pos }
+func (n *condCall) position() int    { return n.pos }
+func (n *condUnary) position() int   { return n.pos }
+func (n *condBinary) position() int  { return n.pos }
+
+// parser
+
+type condParser struct {
+	tokens []condToken
+	next   int
+	pairs  []condPair
+}
+
+func (p *condParser) peek() condToken {
+	return p.tokens[p.next]
+}
+
+func (p *condParser) take() condToken {
+	t := p.tokens[p.next]
+	if t.kind != condEOF {
+		p.next++
+	}
+	return t
+}
+
+func (p *condParser) isOp(ops ...string) bool {
+	t := p.peek()
+	if t.kind != condOp {
+		return false
+	}
+	for _, op := range ops {
+		if t.text == op {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *condParser) expect(kind condTokenKind, what string) (condToken, error) {
+	t := p.take()
+	if t.kind != kind {
+		return t, condErrorf(t.pos, "expected %s, found %q", what, t.text)
+	}
+	return t, nil
+}
+
+func (p *condParser) parseOr() (condNode, error) {
+	return p.parseBinary(p.parseAnd, "OR")
+}
+
+func (p *condParser) parseAnd() (condNode, error) {
+	return p.parseBinary(p.parseNot, "AND")
+}
+
+func (p *condParser) parseNot() (condNode, error) {
+	if p.isOp("NOT") {
+		t := p.take()
+		x, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &condUnary{pos: t.pos, op: "NOT", x: x}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *condParser) parseComparison() (condNode, error) {
+	x, err := p.parseSum()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.isOp("<", "<=", ">", ">=", "==", "!=") {
+		t := p.take()
+		y, err := p.parseSum()
+		if err != nil {
+			return nil, err
+		}
+		x = &condBinary{pos: t.pos, op: t.text, x: x, y: y}
+
+		if p.isOp("<", "<=", ">", ">=", "==", "!=") {
+			return nil, condErrorf(p.peek().pos, "comparisons cannot be chained, use AND")
+		}
+	}
+
+	return x, nil
+}
+
+func (p *condParser) parseSum() (condNode, error) {
+	return p.parseBinary(p.parseProduct, "+", "-")
+}
+
+func (p *condParser) parseProduct() (condNode, error) {
+	return p.parseBinary(p.parseUnary, "*", "/")
+}
+
+// parseBinary parses a left associative chain of operands joined by ops
+func (p *condParser) parseBinary(operand func() (condNode, error), ops ...string) (condNode, error) {
+	x, err := operand()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.isOp(ops...) {
+		t := p.take()
+		y, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		x = &condBinary{pos: t.pos, op: t.text, x: x, y: y}
+	}
+
+	return x, nil
+}
+
+func (p *condParser) parseUnary() (condNode, error) {
+	if p.isOp("-", "+") {
+		t := p.take()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		if t.text == "+" {
+			return x, nil
+		}
+		return &condUnary{pos: t.pos, op: "-", x: x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *condParser) parsePrimary() (condNode, error) {
+	t := p.take()
+
+	switch t.kind {
+	case condNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, condErrorf(t.pos, "invalid number %q", t.text)
+		}
+		lit := &condLiteral{pos: t.pos, value: v}
+		if p.isOp("%") {
+			p.take()
+			lit.percent = true
+		}
+		return lit, nil
+
+	case condLParen:
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(condRParen, "\")\""); err != nil {
+			return nil, err
+		}
+		return x, nil
+
+	case condIdent:
+		return p.parseCall(t)
+	}
+
+	return nil, condErrorf(t.pos, "unexpected %q", t.text)
+}
+
+func (p *condParser) parseCall(name condToken) (condNode, error) {
+	fn := strings.ToLower(name.text)
+	if _, ok := conditionFuncs[fn]; !ok && fn != "price" {
+		return nil, condErrorf(name.pos, "unknown function %q, use price, change_1h, change_24h or change_7d", name.text)
+	}
+
+	if _, err := p.expect(condLParen, "\"(\" after "+fn); err != nil {
+		return nil, err
+	}
+
+	token, err := p.expect(condIdent, "a token symbol")
+	if err != nil {
+		return nil, err
+	}
+	call := &condCall{pos: name.pos, fn: fn, token: normalizeToken(token.text)}
+
+	if p.peek().kind == condComma {
+		p.take()
+		quote, err := p.expect(condIdent, "a quote currency")
+		if err != nil {
+			return nil, err
+		}
+		call.quote = normalizeToken(quote.text)
+	}
+
+	if _, err := p.expect(condRParen, "\")\""); err != nil {
+		return nil, err
+	}
+
+	p.pairs = append(p.pairs, condPair{Token: call.token, Quote: call.quote})
+	return call, nil
+}
+
+// type checker
+
+func typeCheck(n condNode) (condType, error) {
+	switch n := n.(type) {
+	case *condLiteral:
+		if n.percent {
+			return condPercent, nil
+		}
+		return condNum, nil
+
+	case *condCall:
+		if n.fn == "price" {
+			return condNum, nil
+		}
+		return condPercent, nil
+
+	case *condUnary:
+		x, err := typeCheck(n.x)
+		if err != nil {
+			return x, err
+		}
+		if n.op == "NOT" {
+			if x != condBool {
+				return x, condErrorf(n.pos, "NOT needs a condition, not a %s", x)
+			}
+			return condBool, nil
+		}
+		if x == condBool {
+			return x, condErrorf(n.pos, "cannot negate a condition, use NOT")
+		}
+		return x, nil
+
+	case *condBinary:
+		x, err := typeCheck(n.x)
+		if err != nil {
+			return x, err
+		}
+		y, err := typeCheck(n.y)
+		if err != nil {
+			return y, err
+		}
+		return binaryType(n, x, y)
+	}
+
+	return condBool, condErrorf(n.position(), "unsupported expression")
+}
+
+func binaryType(n *condBinary, x, y condType) (condType, error) {
+	switch n.op {
+	case "AND", "OR":
+		if x != condBool || y != condBool {
+			return condBool, condErrorf(n.pos, "%s joins conditions, not a %s and a %s", n.op, x, y)
+		}
+		return condBool, nil
+
+	case "<", "<=", ">", ">=", "==", "!=":
+		if x == condBool || y == condBool {
+			return condBool, condErrorf(n.pos, "cannot compare conditions with %s", n.op)
+		}
+		if x != y {
+			return condBool, condErrorf(n.pos, "cannot compare a %s with a %s, write percentages like -5%%", x, y)
+		}
+		return condBool, nil
+
+	case "+", "-":
+		if x == condBool || y == condBool || x != y {
+			return condBool, condErrorf(n.pos, "cannot %s a %s and a %s", arithmeticVerb(n.op), x, y)
+		}
+		return x, nil
+
+	default: // "*", "/"
+		if x == condBool || y == condBool || (x == condPercent && y == condPercent) || (n.op == "/" && y == condPercent) {
+			return condBool, condErrorf(n.pos, "cannot %s a %s and a %s", arithmeticVerb(n.op), x, y)
+		}
+		if x == condPercent || y == condPercent {
+			return condPercent, nil
+		}
+		return condNum, nil
+	}
+}
+
+func arithmeticVerb(op string) string {
+	switch op {
+	case "+":
+		return "add"
+	case "-":
+		return "subtract"
+	case "*":
+		return "multiply"
+	default:
+		return "divide"
+	}
+}
+
+// evaluator
+
+type condValue struct {
+	n float64
+	b bool
+}
+
+func evalNode(n condNode, env condEnv, quote string) (condValue, error) {
+	switch n := n.(type) {
+	case *condLiteral:
+		return condValue{n: n.value}, nil
+
+	case *condCall:
+		q := n.quote
+		if q == "" {
+			q = quote
+		}
+		if n.fn == "price" {
+			v, err := env.price(n.token, q)
+			return condValue{n: v}, err
+		}
+		v, err := env.change(n.token, q, conditionFuncs[n.fn])
+		return condValue{n: v}, err
+
+	case *condUnary:
+		x, err := evalNode(n.x, env, quote)
+		if err != nil {
+			return x, err
+		}
+		if n.op == "NOT" {
+			return condValue{b: !x.b}, nil
+		}
+		return condValue{n: -x.n}, nil
+
+	case *condBinary:
+		x, err := evalNode(n.x, env, quote)
+		if err != nil {
+			return x, err
+		}
+
+		// short circuit so missing data on one side does not matter
+		switch {
+		case n.op == "AND" && !x.b:
+			return condValue{b: false}, nil
+		case n.op == "OR" && x.b:
+			return condValue{b: true}, nil
+		}
+
+		y, err := evalNode(n.y, env, quote)
+		if err != nil {
+			return y, err
+		}
+		return evalBinary(n, x, y)
+	}
+
+	return condValue{}, condErrorf(n.position(), "unsupported expression")
+}
+
+func evalBinary(n *condBinary, x, y condValue) (condValue, error) {
+	switch n.op {
+	case "AND", "OR":
+		return condValue{b: y.b}, nil
+	case "<":
+		return condValue{b: x.n < y.n}, nil
+	case "<=":
+		return condValue{b: x.n <= y.n}, nil
+	case ">":
+		return condValue{b: x.n > y.n}, nil
+	case ">=":
+		return condValue{b: x.n >= y.n}, nil
+	case "==":
+		return condValue{b: x.n == y.n}, nil
+	case "!=":
+		return condValue{b: x.n != y.n}, nil
+	case "+":
+		return condValue{n: x.n + y.n}, nil
+	case "-":
+		return condValue{n: x.n - y.n}, nil
+	case "*":
+		return condValue{n: x.n * y.n}, nil
+	default:
+		if y.n == 0 {
+			return condValue{}, condErrorf(n.pos, "division by zero")
+		}
+		return condValue{n: x.n / y.n}, nil
+	}
+}
@@ -0,0 +1,117 @@
+package main_test
+
+import (
+	"crypto-go/main"
+	"testing"
+)
+
+var conditionEnv = main.ConditionEnv{
+	Prices:  map[string]float64{"ETH/USD": 3000, "BTC/USD": 60000, "ETH/EUR": 2800},
+	Changes: map[string]float64{"ETH/USD/24h0m0s": -6, "ETH/USD/1h0m0s": 1.5},
+}
+
+// Test parsing and type checking conditions, and the columns of the errors
+func TestParseCondition(t *testing.T) {
+	cases := []struct {
+		src string
+		err string
+	}{
+		{`price(ETH) > 3000 AND change_24h(ETH) < -5%`, ""},
+		{`price(eth, eur) >= 2500 || !(change_1h(BTC) > -2%)`, ""},
+		{`change_1h(ETH) * 2 > 2.5%`, ""},
+
+		// syntax
+		{`price(ETH) / price(BTC) <`, `invalid condition at column 26: unexpected "end of condition"`},
+		{`price(ETH) > 1 > 2`, "invalid condition at column 16: comparisons cannot be chained, use AND"},
+		{`price(ETH) > 1 $ 2`, "invalid condition at column 16: unexpected character '$'"},
+		{`price(ETH > 1`, `invalid condition at column 11: expected ")", found ">"`},
+		{`price() > 1`, `invalid condition at column 7: expected a token symbol, found ")"`},
+		{`price(ETH,) > 1`, `invalid condition at column 11: expected a quote currency, found ")"`},
+		{`price(ETH) > 1 price(BTC)`, `invalid condition at column 16: unexpected "price"`},
+
+		// unknown identifiers
+		{`pric(ETH) > 1`, `invalid condition at column 1: unknown function "pric", use price, change_1h, change_24h or change_7d`},
+		{`price(ETH) > threshold`, `invalid condition at column 14: unknown function "threshold", use price, change_1h, change_24h or change_7d`},
+		{`price(ETH) > 1 AND ETH`, `invalid condition at column 20: unknown function "ETH", use price, change_1h, change_24h or change_7d`},
+
+		// types
+		{`price(ETH) + 1`, "invalid condition at column 12: expression is a number, not a true/false condition"},
+		{`change_24h(ETH) < -5`, "invalid condition at column 17: cannot compare a percentage with a number, write percentages like -5%"},
+		{`price(ETH) > 5%`, "invalid condition at column 12: cannot compare a number with a percentage, write percentages like -5%"},
+		{`change_1h(ETH) + 1 > 0%`, "invalid condition at column 16: cannot add a percentage and a number"},
+		{`5% * 5% > 1%`, "invalid condition at column 4: cannot multiply a percentage and a percentage"},
+		{`price(ETH) / change_1h(ETH) > 1`, "invalid condition at column 12: cannot divide a number and a percentage"},
+		{`price(ETH) > 1 AND 2`, "invalid condition at column 16: AND joins conditions, not a condition and a number"},
+		{`NOT price(ETH)`, "invalid condition at column 1: NOT needs a condition, not a number"},
+		{`-(price(ETH) > 1) > 0`, "invalid condition at column 1: cannot negate a condition, use NOT"},
+		{`(1 > 2) == (2 > 3)`, "invalid condition at column 9: cannot compare conditions with =="},
+	}
+
+	for _, c := range cases {
+		err := main.ParseCondition(c.src)
+		if c.err == "" && err != nil {
+			t.Errorf("Expected %q to parse. Got '%v'", c.src, err)
+		} else if c.err != "" && (err == nil || err.Error() != c.err) {
+			t.Errorf("Expected %q to fail with '%s'. Got '%v'", c.src, c.err, err)
+		}
+	}
+}
+
+// Test evaluating conditions against prices and stored changes
+func TestEvalCondition(t *testing.T) {
+	cases := []struct {
+		src      string
+		expected bool
+		err      string
+	}{
+		// precedence and associativity
+		{`1 + 2 * 3 == 7`, true, ""},
+		{`(1 + 2) * 3 == 9`, true, ""},
+		{`10 - 4 - 3 == 3`, true, ""},
+		{`12 / 3 / 2 == 2`, true, ""},
+		{`price(ETH) - 1000 * 2 > 1001`, false, ""},
+		{`-price(ETH) < 0`, true, ""},
+		{`- -2 == 2`, true, ""},
+		{`NOT 1 > 2 AND 2 > 3`, false, ""},
+		{`3 > 2 OR 1 > 2 AND 2 > 3`, true, ""},
+		{`NOT (3 > 2 OR 1 > 2)`, false, ""},
+		{`price(ETH) / price(BTC) < 0.06`, true, ""},
+		{`price(ETH, EUR) < price(ETH)`, true, ""},
+		{`price(eth) == 3000 && !(price(BTC) < 1)`, true, ""},
+
+		// AND and OR skip their right side once the result is known
+		{`1 > 2 AND price(XRP) > 1`, false, ""},
+		{`1 < 2 OR price(XRP) > 1`, true, ""},
+		{`1 < 2 OR change_24h(XRP) > 1%`, true, ""},
+		{`1 < 2 AND price(XRP) > 1`, false, "no price for XRP/USD"},
+		{`1 > 2 OR price(XRP) > 1`, false, "no price for XRP/USD"},
+
+		// percentages
+		{`change_24h(ETH) < -5%`, true, ""},
+		{`change_1h(ETH) * 2 > 2.5%`, true, ""},
+		{`2 * change_1h(ETH) < 3%`, false, ""},
+		{`change_1h(ETH) / 2 == 0.75%`, true, ""},
+		{`change_1h(ETH) - 1% > 0%`, true, ""},
+		{`change_24h(ETH) < change_1h(ETH)`, true, ""},
+
+		// division by zero
+		{`price(ETH) / (price(BTC) - price(BTC)) > 1`, false, "invalid condition at column 12: division by zero"},
+		{`1 > 2 AND 1 / 0 > 1`, false, ""},
+
+		// missing history
+		{`change_7d(ETH) < -10%`, false, main.ErrNoHistory.Error()},
+		{`price(ETH) > 1 OR change_7d(ETH) < -10%`, true, ""},
+	}
+
+	for _, c := range cases {
+		got, err := main.EvalCondition(c.src, conditionEnv, "USD")
+		switch {
+		case c.err == "" && err != nil:
+			t.Errorf("Expected %q to evaluate. Got '%v'", c.src, err)
+		case c.err != "" && (err == nil || err.Error() != c.err):
+			t.Errorf("Expected %q to fail with '%s'. Got '%v'", c.src, c.err, err)
+		case err == nil && got != c.expected:
+			t.Errorf("Expected %q to be %v. Got %v", c.src, c.expected, got)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// config is read from config.json next to the binary
+type config struct {
+	Port         string   `json:"port"`
+	LogLevel     string   `json:"log_level"`
+	LogFormat    string   `json:"log_format"`
+	NexmoAPIKey  string   `json:"nexmo_api_key"`
+	NexmoSecret  string   `json:"nexmo_secret"`
+	NexmoFrom    string   `json:"nexmo_from"`
+	PollInterval duration `json:"poll_interval"`
+
+	// limits of the HTTP server; streams are exempt from WriteTimeout
+	ReadTimeout     duration `json:"read_timeout"`
+	WriteTimeout    duration `json:"write_timeout"`
+	IdleTimeout     duration `json:"idle_timeout"`
+	MaxHeaderBytes  int      `json:"max_header_bytes"`
+	ShutdownTimeout duration `json:"shutdown_timeout"`
+
+	// with TLSCert and TLSKey set the server speaks HTTPS; RedirectPort
+	// optionally serves redirects from plain HTTP
+	TLSCert      string `json:"tls_cert"`
+	TLSKey       string `json:"tls_key"`
+	RedirectPort string `json:"redirect_port"`
+
+	// raw price samples are kept for PriceRetention, then downsampled to
+	// hourly rows which are kept for PriceHistory
+	PriceRetention duration `json:"price_retention"`
+	PriceHistory   duration `json:"price_history"`
+
+	// DailyLimits caps the messages a user receives per channel and day,
+	// e.g. {"sms": 20}; channels without a limit are not capped
+	DailyLimits map[string]int `json:"daily_limits"`
+
+	// alerts recorded again for the same crossing within DedupWindow are
+	// dropped
+	DedupWindow duration `json:"dedup_window"`
+
+	// notifications are sent by DeliveryWorkers workers and dead-lettered
+	// after DeliveryAttempts failed attempts
+	DeliveryWorkers  int `json:"delivery_workers"`
+	DeliveryAttempts int `json:"delivery_attempts"`
+
+	// Admins lists the emails of the users allowed to use the /admin routes
+	Admins []string `json:"admins"`
+
+	// RateLimits limits the requests per client of each route group, e.g.
+	// {"auth": "10/1m"}
+	RateLimits map[string]RateLimit `json:"rate_limits"`
+
+	// CORS lists the other origins, such as the web frontend, allowed to
+	// call the API from a browser
+	CORS CORS `json:"cors"`
+
+	// Tracing selects the span exporter: "otlp" sends to OTLPEndpoint
+	// (host:port, plain HTTP with OTLPInsecure), "stdout" prints the spans
+	// and "" disables tracing
+	Tracing      string `json:"tracing"`
+	OTLPEndpoint string `json:"otlp_endpoint"`
+	OTLPInsecure bool   `json:"otlp_insecure"`
+}
+
+// duration is a time.Duration written as a string such as "30s" in JSON
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// defaultConfig holds the settings used for anything config.json leaves out
+func defaultConfig() config {
+	return config{
+		Port:         "8080",
+		LogLevel:     "info",
+		LogFormat:    "json",
+		NexmoFrom:    "CryptoGo",
+		PollInterval: duration{time.Minute},
+
+		ReadTimeout:     duration{15 * time.Second},
+		WriteTimeout:    duration{30 * time.Second},
+		IdleTimeout:     duration{2 * time.Minute},
+		MaxHeaderBytes:  1 << 20,
+		ShutdownTimeout: duration{30 * time.Second},
+
+		PriceRetention: duration{7 * 24 * time.Hour},
+		PriceHistory:   duration{365 * 24 * time.Hour},
+
+		DailyLimits: map[string]int{"sms": 20},
+		DedupWindow: duration{time.Hour},
+
+		DeliveryWorkers:  4,
+		DeliveryAttempts: 5,
+
+		RateLimits: map[string]RateLimit{
+			limitAuth:   {Requests: 10, Per: time.Minute},
+			limitAPI:    {Requests: 300, Per: time.Minute},
+			limitStream: {Requests: 30, Per: time.Minute},
+		},
+		CORS: defaultCORS(),
+	}
+}
+
+// loadConfig reads the config file at path on top of the defaults. A missing
+// file is not an error.
+func loadConfig(path string) (config, error) {
+	cfg := defaultConfig()
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return cfg, nil
+	}
+	if err != nil {
+		return cfg, err
+	}
+	defer f.Close()
+
+	if err := json.NewDecoder(f).Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("%s: %v", path, err)
+	}
+
+	return cfg, nil
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// CORS lists the cross-origin requests browsers may make to the API. With
+// no allowed origins cross-origin requests are refused.
+type CORS struct {
+	// AllowedOrigins are origins such as "https://app.example.com", or "*"
+	// for any origin
+	AllowedOrigins   []string `json:"allowed_origins"`
+	AllowedMethods   []string `json:"allowed_methods"`
+	AllowedHeaders   []string `json:"allowed_headers"`
+	AllowCredentials bool     `json:"allow_credentials"`
+	// MaxAge is how many seconds browsers may cache a preflight response
+	MaxAge int `json:"max_age"`
+}
+
+// exposedHeaders are the response headers scripts of other origins may read
+var exposedHeaders = []string{
+	"Link", "X-Total-Count", "Retry-After", "X-Request-ID", "Deprecation", "Sunset",
+	"X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset",
+}
+
+// defaultCORS returns the methods and headers used by the API, without any
+// allowed origin
+func defaultCORS() CORS {
+	return CORS{
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders: []string{"Authorization", "Content-Type", "X-Request-ID"},
+		MaxAge:         600,
+	}
+}
+
+func (c *CORS) allowsOrigin(origin string) bool {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" || strings.EqualFold(o, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *CORS) allowsMethod(method string) bool {
+	for _, m := range c.AllowedMethods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// allowOrigin returns the Access-Control-Allow-Origin value for origin.
+// Credentialed requests need the origin itself rather than "*".
+func (c *CORS) allowOrigin(origin string) string {
+	for _, o := range c.AllowedOrigins {
+		if o == "*" && !c.AllowCredentials {
+			return "*"
+		}
+	}
+	return origin
+}
+
+// cors adds the CORS headers configured in a.CORS to the responses of
+// allowed origins and answers preflight requests itself, so they never
+// reach validateToken
+func (a *App) cors(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		c := &a.CORS
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if !c.allowsOrigin(origin) {
+			if preflight {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Set("Access-Control-Allow-Origin", c.allowOrigin(origin))
+		if c.AllowCredentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if !preflight {
+			h.Set("Access-Control-Expose-Headers", strings.Join(exposedHeaders, ", "))
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+		if c.allowsMethod(r.Header.Get("Access-Control-Request-Method")) {
+			h.Set("Access-Control-Allow-Methods", strings.Join(c.AllowedMethods, ", "))
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowedHeaders, ", "))
+			if c.MaxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+			}
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// OPTIONS requests that are not CORS preflights
+func methodNotAllowed(w http.ResponseWriter, r *http.Request) {
+	respondWithError(w, http.StatusMethodNotAllowed, "Method not allowed")
+}
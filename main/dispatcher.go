@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// dispatcher sends the notifications in the outbox with a pool of workers
+type dispatcher struct {
+	db          *sql.DB
+	notifier    notifier
+	workers     int
+	maxAttempts int
+	metrics     *metrics
+	logger      *slog.Logger
+}
+
+// dispatchIdle is how long an idle worker waits before looking for due
+// deliveries again
+const dispatchIdle = time.Second
+
+func newDispatcher(db *sql.DB, n notifier, m *metrics, cfg config) *dispatcher {
+	return &dispatcher{
+		db:          db,
+		notifier:    n,
+		workers:     cfg.DeliveryWorkers,
+		maxAttempts: cfg.DeliveryAttempts,
+		metrics:     m,
+		logger:      slog.Default().With("component", "dispatcher"),
+	}
+}
+
+// run starts the workers and waits for them to stop once ctx is done. A
+// delivery in progress is finished first.
+func (d *dispatcher) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < d.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.work(ctx)
+		}()
+	}
+	wg.Wait()
+}
+
+// work delivers due notifications one at a time until ctx is done
+func (d *dispatcher) work(ctx context.Context) {
+	for {
+		sent, err := d.deliverNext(ctx)
+		if err != nil {
+			d.logger.Error("delivering notification", "error", err)
+		}
+		if sent && err == nil {
+			if ctx.Err() != nil {
+				return
+			}
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(dispatchIdle):
+		}
+	}
+}
+
+// deliverNext claims a due delivery and sends it. The row stays locked
+// until the outcome is stored. It returns false if nothing was due.
+func (d *dispatcher) deliverNext(ctx context.Context) (sent bool, err error) {
+	// a claimed delivery is finished even when ctx is cancelled on shutdown
+	ctx, span := startSpan(context.WithoutCancel(ctx), "dispatcher.deliver")
+	defer func() { endSpan(span, err) }()
+
+	tx, err := withContext(ctx, d.db).Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	n, err := claimDelivery(tx)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	_, notify := startSpan(ctx, "notify "+n.Channel,
+		attribute.Int64("delivery", n.ID), attribute.Int("attempt", n.Attempts+1))
+	err = d.notifier.Notify(n.Recipient, n.Message)
+	endSpan(notify, err)
+
+	if err != nil {
+		d.logger.Warn("notification failed", "delivery", n.ID, "channel", n.Channel, "attempt", n.Attempts+1, "error", err)
+		if err := n.fail(tx, err, d.maxAttempts); err != nil {
+			return false, err
+		}
+		result := "failed"
+		if n.Status == outboxDead {
+			result = "dead"
+		}
+		d.metrics.notified(n.Channel, result)
+	} else {
+		if err := n.complete(tx); err != nil {
+			return false, err
+		}
+		d.metrics.notified(n.Channel, "sent")
+	}
+
+	return true, tx.Commit()
+}
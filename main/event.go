@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// delivery states of an alert event
+const (
+	deliveryPending  = "pending"
+	deliverySent     = "sent"
+	deliveryFailed   = "failed"
+	deliverySkipped  = "skipped"
+	deliveryDeferred = "deferred"
+	deliveryLimited  = "limited"
+)
+
+// alertEvent records a subscription firing and the delivery of its
+// notification.
+type alertEvent struct {
+	ID          int64      `json:"id"`
+	SubID       int        `json:"subscriptionId"`
+	Owner       string     `json:"-"`
+	Token       string     `json:"token"`
+	Quote       string     `json:"quote"`
+	Rule        string     `json:"rule"`
+	Price       float64    `json:"price"`
+	Baseline    float64    `json:"baseline"`
+	Threshold   float64    `json:"threshold"`
+	Message     string     `json:"message"`
+	Channel     string     `json:"channel"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"createdAt"`
+	DeliveredAt *time.Time `json:"deliveredAt,omitempty"`
+}
+
+const eventColumns = "id, sub_id, owner, token, quote, rule, price, baseline, threshold, message, channel, status, error, created_at, delivered_at"
+
+func scanEvent(row scanner, e *alertEvent) error {
+	return row.Scan(&e.ID, &e.SubID, &e.Owner, &e.Token, &e.Quote, &e.Rule, &e.Price, &e.Baseline, &e.Threshold,
+		&e.Message, &e.Channel, &e.Status, &e.Error, &e.CreatedAt, &e.DeliveredAt)
+}
+
+func (e *alertEvent) createEvent(db dbtx) error {
+	if e.Status == "" {
+		e.Status = deliveryPending
+	}
+
+	return db.QueryRow(
+		`INSERT INTO alert_events(sub_id, owner, token, quote, rule, price, baseline, threshold, message, channel, status, error)
+		VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) RETURNING id, created_at`,
+		e.SubID, e.Owner, e.Token, e.Quote, e.Rule, e.Price, e.Baseline, e.Threshold, e.Message, e.Channel, e.Status, e.Error).Scan(&e.ID, &e.CreatedAt)
+}
+
+// updateDelivery stores the outcome of delivering the event's notification
+func (e *alertEvent) updateDelivery(db dbtx) error {
+	if e.Status == deliverySent && e.DeliveredAt == nil {
+		now := time.Now()
+		e.DeliveredAt = &now
+	}
+
+	_, err := db.Exec("UPDATE alert_events SET status=$1, error=$2, delivered_at=$3 WHERE id=$4",
+		e.Status, e.Error, e.DeliveredAt, e.ID)
+
+	return err
+}
+
+// eventQuery selects a page of an owner's events, newest first
+type eventQuery struct {
+	Owner  string
+	SubID  int
+	Before int64
+	Count  int
+}
+
+// listEvents returns a page of events matching q and the cursor of the next
+// page ("" on the last page).
+func listEvents(db dbtx, q eventQuery) ([]alertEvent, string, error) {
+	conds := []string{"owner=$1"}
+	args := []interface{}{q.Owner}
+
+	if q.SubID != 0 {
+		args = append(args, q.SubID)
+		conds = append(conds, fmt.Sprintf("sub_id=$%d", len(args)))
+	}
+	if q.Before != 0 {
+		args = append(args, q.Before)
+		conds = append(conds, fmt.Sprintf("id<$%d", len(args)))
+	}
+
+	args = append(args, q.Count+1)
+	rows, err := db.Query(
+		fmt.Sprintf("SELECT %s FROM alert_events WHERE %s ORDER BY id DESC LIMIT $%d", eventColumns, strings.Join(conds, " AND "), len(args)),
+		args...)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer rows.Close()
+
+	events := []alertEvent{}
+
+	for rows.Next() {
+		var e alertEvent
+		if err := scanEvent(rows, &e); err != nil {
+			return nil, "", err
+		}
+		events = append(events, e)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(events) <= q.Count {
+		return events, "", nil
+	}
+
+	events = events[:q.Count]
+	return events, strconv.FormatInt(events[len(events)-1].ID, 10), nil
+}
+
+// getEventsByStatus returns all events in a delivery state, grouped by owner
+// and oldest first
+func getEventsByStatus(db dbtx, status string) ([]alertEvent, error) {
+	rows, err := db.Query("SELECT "+eventColumns+" FROM alert_events WHERE status=$1 ORDER BY owner, id", status)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	events := []alertEvent{}
+
+	for rows.Next() {
+		var e alertEvent
+		if err := scanEvent(rows, &e); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// GET the caller's alert events, newest first
+func (a *App) getEvents(w http.ResponseWriter, r *http.Request) {
+	a.respondWithEvents(w, r, eventQuery{Owner: userEmail(r)})
+}
+
+// GET the alert events of one of the caller's subscriptions
+func (a *App) getSubEvents(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid subscription ID")
+		return
+	}
+
+	s := sub{ID: id, Owner: userEmail(r)}
+	if err := s.getSub(a.store(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Subscription not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	a.respondWithEvents(w, r, eventQuery{Owner: s.Owner, SubID: id})
+}
+
+// respondWithEvents pages through the events selected by q using the count
+// and cursor parameters
+func (a *App) respondWithEvents(w http.ResponseWriter, r *http.Request, q eventQuery) {
+	q.Count = 20
+	if v := r.FormValue("count"); v != "" {
+		count, err := strconv.Atoi(v)
+		if err != nil || count < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid count")
+			return
+		}
+		if count > 100 {
+			count = 100
+		}
+		q.Count = count
+	}
+
+	if v := r.FormValue("cursor"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || before < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		q.Before = before
+	}
+
+	events, next, err := listEvents(a.store(r), q)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if next != "" {
+		values := r.URL.Query()
+		values.Set("cursor", next)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, values.Encode()))
+	}
+
+	respondWithJSON(w, http.StatusOK, events)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// This file exposes internals to the tests of package main_test.
+
+// ErrNoHistory is returned by the change functions of conditions without
+// enough stored prices
+var ErrNoHistory = errNoHistory
+
+// ConditionEnv serves the prices of ConditionEval from maps keyed by
+// "TOKEN/QUOTE" and the changes from maps keyed by "TOKEN/QUOTE/window",
+// e.g. "ETH/USD/24h0m0s". Missing changes give ErrNoHistory.
+type ConditionEnv struct {
+	Prices  map[string]float64
+	Changes map[string]float64
+}
+
+func (e ConditionEnv) price(token, quote string) (float64, error) {
+	p, ok := e.Prices[token+"/"+quote]
+	if !ok {
+		return 0, fmt.Errorf("no price for %s/%s", token, quote)
+	}
+	return p, nil
+}
+
+func (e ConditionEnv) change(token, quote string, window time.Duration) (float64, error) {
+	c, ok := e.Changes[fmt.Sprintf("%s/%s/%s", token, quote, window)]
+	if !ok {
+		return 0, errNoHistory
+	}
+	return c, nil
+}
+
+// ParseCondition parses and type checks src
+func ParseCondition(src string) error {
+	_, err := parseCondition(src)
+	return err
+}
+
+// EvalCondition parses src and evaluates it against env with quote as the
+// default quote currency
+func EvalCondition(src string, env ConditionEnv, quote string) (bool, error) {
+	c, err := parseCondition(src)
+	if err != nil {
+		return false, err
+	}
+	return c.eval(env, quote)
+}
+
+// FireAlert fires rule for the subscription id of owner the way the watcher
+// does, dropping the alert if the same crossing was recorded within
+// dedupWindow
+func (a *App) FireAlert(owner string, id int, rule string, price, baseline float64, dedupWindow time.Duration) error {
+	s := sub{ID: id, Owner: owner}
+	if err := s.getSub(a.DB); err != nil {
+		return err
+	}
+
+	w := newWatcher(a.DB, nil, logNotifier{}, a.hub, nil, config{DedupWindow: duration{dedupWindow}})
+	w.fire(context.Background(), &s, rule, price, baseline)
+	return nil
+}
+
+// ReserveNotification counts a message against the daily limit of owner
+func ReserveNotification(db *sql.DB, owner, channel, day string, limit int) (bool, error) {
+	return reserveNotification(db, owner, channel, day, limit)
+}
+
+// Quote is the price of Token in Quote as a price source reports it
+type Quote struct {
+	Token string
+	Quote string
+	Price float64
+}
+
+func newQuoteBook(quotes []Quote) quoteBook {
+	book := quoteBook{}
+	for _, q := range quotes {
+		if book[q.Token] == nil {
+			book[q.Token] = map[string]ticker{}
+		}
+		book[q.Token][q.Quote] = ticker{Price: q.Price}
+	}
+	return book
+}
+
+// QuoteRate returns the price of token in quote the way the watcher derives
+// it from quotes
+func QuoteRate(quotes []Quote, token, quote string) (float64, bool) {
+	return newQuoteBook(quotes).rate(token, quote)
+}
+
+// staticSource serves the same prices every round
+type staticSource []Quote
+
+func (s staticSource) Name() string {
+	return "static"
+}
+
+func (s staticSource) Prices(ctx context.Context, tokens, quotes []string) (quoteBook, error) {
+	return newQuoteBook(s), nil
+}
+
+// WatchRounds runs a polling round of a watcher for each element of rounds,
+// with the prices of that element
+func (a *App) WatchRounds(rounds ...[]Quote) error {
+	w := newWatcher(a.DB, nil, logNotifier{}, a.hub, nil, config{})
+	for _, quotes := range rounds {
+		w.source = staticSource(quotes)
+		if err := w.check(context.Background()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// InQuietHours reports whether t falls in the quiet hours from start to end
+// of a user in timezone
+func InQuietHours(timezone, start, end string, t time.Time) bool {
+	u := user{Timezone: timezone, QuietStart: start, QuietEnd: end}
+	return u.inQuietHours(t)
+}
+
+// FlushDeferred runs the digest pass of a watcher once
+func (a *App) FlushDeferred() error {
+	w := newWatcher(a.DB, nil, logNotifier{}, a.hub, nil, config{})
+	return w.flushDeferred(context.Background())
+}
+
+// PrunePrices rolls up and deletes stored prices the way the watcher does
+// with the retention periods raw and max
+func (a *App) PrunePrices(raw, max time.Duration) error {
+	return prunePrices(withContext(context.Background(), a.DB), raw, max)
+}
+
+// CertReloader serves the certificate of a cert and key file
+type CertReloader = certReloader
+
+// NewCertReloader loads the certificate of certFile and keyFile
+func NewCertReloader(certFile, keyFile string) (*CertReloader, error) {
+	return newCertReloader(certFile, keyFile)
+}
+
+// CheckFiles reloads the certificate if its files changed, as the watch
+// loop does on every tick
+func (c *certReloader) CheckFiles() {
+	c.checkFiles()
+}
+
+// RedirectToHTTPS redirects plain HTTP requests to HTTPS on tlsPort
+var RedirectToHTTPS = redirectToHTTPS
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+)
+
+// user event types written to the feed
+const (
+	feedAlert      = "alert"
+	feedSubCreated = "subscription.created"
+	feedSubUpdated = "subscription.updated"
+	feedSubDeleted = "subscription.deleted"
+)
+
+// feedRetention is how long user events stay available for resuming streams
+const feedRetention = 30 * 24 * time.Hour
+
+// userEvent is an entry of a user's event feed. Its id is what clients of
+// the event stream resume from.
+type userEvent struct {
+	ID        int64           `json:"id"`
+	Owner     string          `json:"-"`
+	Type      string          `json:"type"`
+	Data      json.RawMessage `json:"data"`
+	CreatedAt time.Time       `json:"createdAt"`
+}
+
+func (e *userEvent) createUserEvent(db dbtx) error {
+	return db.QueryRow("INSERT INTO user_events(owner, type, data) VALUES($1, $2, $3) RETURNING id, created_at",
+		e.Owner, e.Type, []byte(e.Data)).Scan(&e.ID, &e.CreatedAt)
+}
+
+// getUserEventsAfter returns up to count of owner's events with an id
+// greater than after, oldest first
+func getUserEventsAfter(db dbtx, owner string, after int64, count int) ([]userEvent, error) {
+	rows, err := db.Query(
+		"SELECT id, owner, type, data, created_at FROM user_events WHERE owner=$1 AND id>$2 ORDER BY id LIMIT $3",
+		owner, after, count)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	events := []userEvent{}
+
+	for rows.Next() {
+		var e userEvent
+		if err := rows.Scan(&e.ID, &e.Owner, &e.Type, &e.Data, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+func pruneUserEvents(db dbtx, maxAge time.Duration) error {
+	_, err := db.Exec("DELETE FROM user_events WHERE created_at < $1", time.Now().Add(-maxAge))
+	return err
+}
+
+// publishUserEvent appends payload to owner's feed and pushes it to their
+// open streams, in id order. Failures are logged, they never fail the
+// caller.
+func publishUserEvent(db dbtx, h *hub, owner, typ string, payload interface{}) {
+	if owner == "" {
+		return
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		slog.Error("encoding user event", "component", "feed", "type", typ, "error", err)
+		return
+	}
+
+	// ids are taken when the insert runs, so without the lock two
+	// publishers could push their entries in the opposite order and the
+	// stream would drop the older one
+	defer h.lockFeed(owner)()
+
+	e := userEvent{Owner: owner, Type: typ, Data: data}
+	if err := e.createUserEvent(db); err != nil {
+		slog.Error("recording user event", "component", "feed", "type", typ, "error", err)
+		return
+	}
+
+	h.publishUserEvent(&e)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// states of a readiness check
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// readyTimeout bounds the dependency checks of /readyz
+const readyTimeout = 2 * time.Second
+
+// staleRounds is how many poll intervals may pass without a successful
+// polling round before the prices count as stale
+const staleRounds = 3
+
+// checkResult is the outcome of one readiness check
+type checkResult struct {
+	Status     string  `json:"status"`
+	DurationMs float64 `json:"durationMs"`
+	Detail     string  `json:"detail,omitempty"`
+}
+
+// readiness is the body of /readyz
+type readiness struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// GET /healthz answers as long as the process is serving requests
+func (a *App) healthz(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]string{"status": checkOK})
+}
+
+// GET /readyz checks the database, the freshness of the prices and the
+// notifier. It answers 503 if any check fails.
+func (a *App) readyz(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	res := readiness{Status: checkOK, Checks: map[string]checkResult{}}
+	run := func(name string, check func(context.Context) (string, error)) {
+		start := time.Now()
+		status, err := check(ctx)
+		c := checkResult{Status: status, DurationMs: float64(time.Since(start).Microseconds()) / 1000}
+		if err != nil {
+			c.Detail = err.Error()
+		}
+		if status == checkFail {
+			res.Status = checkFail
+		}
+		res.Checks[name] = c
+	}
+
+	run("database", a.checkDatabase)
+	run("prices", a.checkPrices)
+	run("notifier", a.checkNotifier)
+
+	code := http.StatusOK
+	if res.Status == checkFail {
+		code = http.StatusServiceUnavailable
+	}
+	respondWithJSON(w, code, res)
+}
+
+func (a *App) checkDatabase(ctx context.Context) (string, error) {
+	if err := a.DB.PingContext(ctx); err != nil {
+		return checkFail, err
+	}
+	return checkOK, nil
+}
+
+// checkPrices fails when the watcher has not completed a polling round for
+// several intervals
+func (a *App) checkPrices(ctx context.Context) (string, error) {
+	if a.watcher == nil {
+		return checkWarn, errors.New("price watcher is not running")
+	}
+
+	last := a.watcher.lastSuccess()
+	if last.IsZero() {
+		return checkFail, fmt.Errorf("no successful %s polling round yet", a.watcher.source.Name())
+	}
+	if age := time.Since(last); age > staleRounds*a.watcher.interval {
+		return checkFail, fmt.Errorf("last successful %s polling round %s ago", a.watcher.source.Name(), age.Round(time.Second))
+	}
+
+	return checkOK, nil
+}
+
+// checkNotifier warns when alerts are only logged instead of being sent
+func (a *App) checkNotifier(ctx context.Context) (string, error) {
+	if a.watcher == nil {
+		return checkWarn, errors.New("price watcher is not running")
+	}
+	if _, ok := a.watcher.notifier.(logNotifier); ok {
+		return checkWarn, errors.New("no nexmo credentials, alerts are only logged")
+	}
+	return checkOK, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// streamMessage is what the hub sends to connected clients
+type streamMessage struct {
+	Type  string      `json:"type"`
+	Token string      `json:"token,omitempty"`
+	Quote string      `json:"quote,omitempty"`
+	Price float64     `json:"price,omitempty"`
+	Time  time.Time   `json:"time"`
+	Event *alertEvent `json:"event,omitempty"`
+}
+
+// hubFrame is a message queued for a client. id and event are only set for
+// user feed entries.
+type hubFrame struct {
+	id    int64
+	event string
+	data  []byte
+}
+
+// hubClient is a connection registered with the hub. Messages are queued on
+// send; a client whose queue is full is too slow and gets dropped. Feed
+// clients (the event stream) receive user events, the others receive ticks
+// and alerts.
+type hubClient struct {
+	owner string
+	feed  bool
+	send  chan hubFrame
+
+	// tokens the client asked for price ticks of, guarded by the hub's lock
+	tokens map[string]bool
+
+	closeOnce sync.Once
+	done      chan struct{}
+	reason    string
+}
+
+func newHubClient(owner string, feed bool, queue int) *hubClient {
+	return &hubClient{
+		owner:  owner,
+		feed:   feed,
+		send:   make(chan hubFrame, queue),
+		tokens: map[string]bool{},
+		done:   make(chan struct{}),
+	}
+}
+
+// close signals the connection to shut down, telling the peer why if reason
+// is set; only the first call has any effect
+func (c *hubClient) close(reason string) {
+	c.closeOnce.Do(func() {
+		c.reason = reason
+		close(c.done)
+	})
+}
+
+// feedLockStripes is the number of locks user feeds are spread over
+const feedLockStripes = 64
+
+// hub fans price ticks and alert events out to the connected clients
+type hub struct {
+	mu      sync.RWMutex
+	clients map[*hubClient]bool
+
+	// feedLocks serialize appending to a user's feed and pushing the entry,
+	// so their streams receive the entries in id order
+	feedLocks [feedLockStripes]sync.Mutex
+}
+
+func newHub() *hub {
+	return &hub{clients: map[*hubClient]bool{}}
+}
+
+// lockFeed locks owner's feed and returns the function unlocking it
+func (h *hub) lockFeed(owner string) func() {
+	if h == nil {
+		return func() {}
+	}
+
+	f := fnv.New32a()
+	f.Write([]byte(owner))
+	m := &h.feedLocks[f.Sum32()%feedLockStripes]
+	m.Lock()
+	return m.Unlock
+}
+
+func (h *hub) register(c *hubClient) {
+	h.mu.Lock()
+	h.clients[c] = true
+	h.mu.Unlock()
+}
+
+func (h *hub) unregister(c *hubClient) {
+	h.mu.Lock()
+	delete(h.clients, c)
+	h.mu.Unlock()
+	c.close("")
+}
+
+// closeAll disconnects every client, e.g. when the server shuts down
+func (h *hub) closeAll(reason string) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range h.clients {
+		c.close(reason)
+	}
+}
+
+// subscribe adds (or with on false removes) tokens to the ticks c receives
+func (h *hub) subscribe(c *hubClient, tokens []string, on bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for _, t := range tokens {
+		if t = normalizeToken(t); t == "" {
+			continue
+		}
+		if on {
+			c.tokens[t] = true
+		} else {
+			delete(c.tokens, t)
+		}
+	}
+}
+
+// publishTick sends a price to every client subscribed to its token
+func (h *hub) publishTick(token, quote string, price float64, t time.Time) {
+	msg := streamMessage{Type: "tick", Token: token, Quote: quote, Price: price, Time: t}
+	h.broadcast(msg, func(c *hubClient) bool { return c.tokens[token] })
+}
+
+// publishEvent sends an alert event to the connections of its owner
+func (h *hub) publishEvent(e *alertEvent) {
+	msg := streamMessage{Type: "alert", Time: e.CreatedAt, Event: e}
+	h.broadcast(msg, func(c *hubClient) bool { return !c.feed && c.owner == e.Owner })
+}
+
+// publishUserEvent sends an entry of a user's feed to their event streams
+func (h *hub) publishUserEvent(e *userEvent) {
+	if h == nil {
+		return
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("encoding stream message", "component", "hub", "error", err)
+		return
+	}
+
+	h.send(hubFrame{id: e.ID, event: e.Type, data: b}, func(c *hubClient) bool { return c.feed && c.owner == e.Owner })
+}
+
+func (h *hub) broadcast(msg streamMessage, match func(*hubClient) bool) {
+	if h == nil {
+		return
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		slog.Error("encoding stream message", "component", "hub", "error", err)
+		return
+	}
+
+	h.send(hubFrame{data: b}, match)
+}
+
+func (h *hub) send(f hubFrame, match func(*hubClient) bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	for c := range h.clients {
+		if !match(c) {
+			continue
+		}
+		select {
+		case c.send <- f:
+		default:
+			// the client is not keeping up, disconnect it rather than
+			// blocking everyone else
+			c.close("too slow")
+		}
+	}
+}
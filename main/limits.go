@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// digestIntervals are the digest modes a user can choose. Alerts of a user
+// with a digest mode are held back and sent as one message once the oldest
+// of them is that old.
+var digestIntervals = map[string]time.Duration{
+	"hourly": time.Hour,
+	"daily":  24 * time.Hour,
+}
+
+// inCooldown reports whether s fired less than its cooldown before now
+func (s *sub) inCooldown(db dbtx, now time.Time) (bool, error) {
+	if s.Cooldown <= 0 {
+		return false, nil
+	}
+
+	var n int
+	err := db.QueryRow("SELECT COUNT(*) FROM alert_events WHERE sub_id=$1 AND created_at>$2",
+		s.ID, now.Add(-time.Duration(s.Cooldown)*time.Second)).Scan(&n)
+
+	return n > 0, err
+}
+
+// isDuplicate reports whether the same subscription already recorded this
+// crossing within window: the same rule and threshold, crossed from the same
+// baseline. Seeing it again at a slightly different price (e.g. from a
+// second watcher) is a duplicate, crossing again after the price went back
+// is not; spacing out real alerts is left to the cooldown. Conditions have
+// no baseline, so they also have to fire at the same price.
+func (e *alertEvent) isDuplicate(db dbtx, window time.Duration) (bool, error) {
+	if window <= 0 {
+		return false, nil
+	}
+
+	var n int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM alert_events WHERE sub_id=$1 AND rule=$2 AND created_at>$3
+		AND threshold=$4::numeric(30,10) AND baseline=$5::numeric(30,10)
+		AND (rule<>$6 OR price=$7::numeric(30,10))`,
+		e.SubID, e.Rule, time.Now().Add(-window), e.Threshold, e.Baseline, ruleCond, e.Price).Scan(&n)
+
+	return n > 0, err
+}
+
+// reserveNotification counts a message to owner on channel against the
+// owner's daily limit for that channel. It returns false, and counts
+// nothing, when the limit for day has been reached.
+func reserveNotification(db dbtx, owner, channel, day string, limit int) (bool, error) {
+	if limit <= 0 {
+		return false, nil
+	}
+
+	var n int
+	err := db.QueryRow(
+		`INSERT INTO notification_counts(owner, channel, day, count) VALUES($1, $2, $3, 1)
+		ON CONFLICT (owner, channel, day) DO UPDATE SET count=notification_counts.count+1
+		WHERE notification_counts.count<$4 RETURNING count`,
+		owner, channel, day, limit).Scan(&n)
+
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// pruneNotificationCounts deletes the counters of days before the given one
+func pruneNotificationCounts(db dbtx, before string) error {
+	_, err := db.Exec("DELETE FROM notification_counts WHERE day<$1", before)
+
+	return err
+}
+
+// localDay returns the date of t in the user's timezone as "2006-01-02"
+func (u *user) localDay(t time.Time) string {
+	return t.In(u.location()).Format("2006-01-02")
+}
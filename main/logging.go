@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// newLogger returns the logger configured by log_level and log_format
+func newLogger(cfg config) (*slog.Logger, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+		return nil, fmt.Errorf("log_level: %v", err)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch cfg.LogFormat {
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	}
+
+	return nil, fmt.Errorf("log_format: unknown format %q, use json or text", cfg.LogFormat)
+}
+
+// loggerKey holds the logger of a request in its context
+const loggerKey contextKey = "logger"
+
+// requestKey holds the *requestInfo of a request in its context
+const requestKey contextKey = "request"
+
+// requestInfo collects what the access log reports about a request
+type requestInfo struct {
+	ID   string
+	User string
+}
+
+// loggerFrom returns the logger of a request context, or the default logger
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
+
+// withLogger returns a copy of ctx carrying l
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// noteRequestUser records the authenticated user of a request for the
+// access log
+func noteRequestUser(r *http.Request, email string) {
+	if info, ok := r.Context().Value(requestKey).(*requestInfo); ok {
+		info.User = email
+	}
+}
+
+// setRequestUser returns r authenticated as email, with the user added to
+// its logger
+func setRequestUser(r *http.Request, email string) *http.Request {
+	noteRequestUser(r, email)
+
+	ctx := context.WithValue(r.Context(), userEmailKey, email)
+	ctx = withLogger(ctx, loggerFrom(ctx).With("user", email))
+	return r.WithContext(ctx)
+}
+
+// maxRequestIDLength bounds the X-Request-ID accepted from clients
+const maxRequestIDLength = 128
+
+// requestIDHandler gives every request an id, taken from a valid
+// X-Request-ID header or generated, and echoes it in the response
+func requestIDHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+
+		ctx := context.WithValue(r.Context(), requestKey, &requestInfo{ID: id})
+		ctx = withLogger(ctx, slog.Default().With("request_id", id))
+		next.ServeHTTP(w, r.WithContext(ctx))
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// loggingHandler writes an access log line for every request
+func loggingHandler(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		if status >= 500 {
+			level = slog.LevelError
+		}
+
+		attrs := []slog.Attr{
+			slog.String("method", r.Method),
+			slog.String("path", r.URL.Path),
+			slog.Int("status", status),
+			slog.Int64("bytes", rec.bytes),
+			slog.Duration("duration", time.Since(start)),
+			slog.String("remote", r.RemoteAddr),
+		}
+		if info, ok := r.Context().Value(requestKey).(*requestInfo); ok && info.User != "" {
+			attrs = append(attrs, slog.String("user", info.User))
+		}
+
+		loggerFrom(r.Context()).LogAttrs(r.Context(), level, "request", attrs...)
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// responseRecorder captures the status and size of a response. It passes
+// flushes and hijacks through so streams keep working.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (rec *responseRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *responseRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += int64(n)
+	return n, err
+}
+
+func (rec *responseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rec *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	if rec.status == 0 {
+		rec.status = http.StatusSwitchingProtocols
+	}
+	return h.Hijack()
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rec *responseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
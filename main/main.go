@@ -1,8 +1,61 @@
 package main
 
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
 func main() {
+	cfg, err := loadConfig("config.json")
+	if err != nil {
+		fatal("loading config", err)
+	}
+
+	logger, err := newLogger(cfg)
+	if err != nil {
+		fatal("configuring logger", err)
+	}
+	slog.SetDefault(logger)
+
+	shutdownTracing, err := setupTracing(context.Background(), cfg)
+	if err != nil {
+		fatal("configuring tracing", err)
+	}
+
 	a := App{}
 	a.Initialize("john", "new_sub_db")
+	a.Admins = cfg.Admins
+	a.RateLimits = cfg.RateLimits
+	a.CORS = cfg.CORS
+
+	if err := a.SeedAssets("assets.json"); err != nil && !os.IsNotExist(err) {
+		fatal("seeding assets", err)
+	}
+
+	// SIGINT or SIGTERM drains the server and stops the background workers
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	a.Watch(ctx, cfg)
+	err = a.Run(ctx, cfg)
+
+	// flush the spans still buffered before exiting
+	flushCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout.Duration)
+	defer cancel()
+	if err := shutdownTracing(flushCtx); err != nil {
+		slog.Error("flushing traces", "error", err)
+	}
+
+	if err != nil {
+		fatal("serving", err)
+	}
+}
 
-	a.Run(":8080")
+// fatal logs err and exits
+func fatal(msg string, err error) {
+	slog.Error(msg, "error", err)
+	os.Exit(1)
 }
@@ -1,15 +1,24 @@
 package main_test
 
 import (
+	"bufio"
 	"bytes"
 	"crypto-go/main"
 	"encoding/json"
 	"fmt"
 	"log"
+	"math"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 var a main.App
@@ -46,14 +55,45 @@ func TestCreateUser(t *testing.T) {
 	}
 }
 
-// Test get user by email
-func TestGetUserByEmail(t *testing.T) {
+// Test rejecting registrations without a valid email
+func TestCreateUserInvalidEmail(t *testing.T) {
 	clearTable("users")
-	addUser()
 
-	payload := []byte(`{"email":"test@email.com"}`)
+	for _, email := range []string{"", "not-an-email", "Test <test@email.com>"} {
+		payload, _ := json.Marshal(map[string]string{"email": email, "password": "mysecurepassword123"})
+
+		req, _ := http.NewRequest("POST", "/users/register", bytes.NewBuffer(payload))
+		response := executeRequest(req)
+
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+	}
+}
+
+// Test that a token without a subject does not authenticate anybody
+func TestTokenWithoutSubject(t *testing.T) {
+	clearTable("subs")
+	addProducts(1)
+
+	token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}).SignedString([]byte("mysecret"))
+
+	for _, path := range []string{"/subscriptions", "/subscriptions/export"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("authorization", token)
+		response := executeRequest(req)
+
+		checkResponseCode(t, http.StatusUnauthorized, response.Code)
+	}
+}
+
+// Test get the profile of the authenticated user
+func TestGetProfile(t *testing.T) {
+	clearTable("users")
+	token := loginTestUser()
 
-	req, _ := http.NewRequest("POST", "/user", bytes.NewBuffer(payload))
+	req, _ := http.NewRequest("GET", "/users/me", nil)
+	req.Header.Set("authorization", token)
 	response := executeRequest(req)
 
 	checkResponseCode(t, http.StatusOK, response.Code)
@@ -63,6 +103,145 @@ func TestGetUserByEmail(t *testing.T) {
 	if m["email"] != "test@email.com" {
 		t.Errorf("Expected the 'email' key of the response to be set to 'test@email.com'. Got '%v'", m["email"])
 	}
+
+	if _, ok := m["password"]; ok {
+		t.Error("Expected the password to be left out of the profile")
+	}
+}
+
+// Test updating the timezone and quiet hours of the authenticated user
+func TestUpdateProfile(t *testing.T) {
+	clearTable("users")
+	token := loginTestUser()
+
+	payload := []byte(`{"number":"15551234567","timezone":"Europe/Berlin","quietStart":"22:00","quietEnd":"07:00"}`)
+
+	req, _ := http.NewRequest("PUT", "/users/me", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["timezone"] != "Europe/Berlin" || m["quietStart"] != "22:00" || m["quietEnd"] != "07:00" {
+		t.Errorf("Expected the timezone and quiet hours to be updated. Got '%v'", m)
+	}
+
+	payload = []byte(`{"timezone":"Mars/Olympus","quietStart":"22:00","quietEnd":"07:00"}`)
+
+	req, _ = http.NewRequest("PUT", "/users/me", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	payload = []byte(`{"timezone":"UTC","digest":"weekly"}`)
+
+	req, _ = http.NewRequest("PUT", "/users/me", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	payload = []byte(`{"timezone":"UTC","digest":"daily"}`)
+
+	req, _ = http.NewRequest("PUT", "/users/me", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	m = nil
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if m["digest"] != "daily" {
+		t.Errorf("Expected digest to be 'daily'. Got '%v'", m["digest"])
+	}
+	if m["number"] != "15551234567" || m["quietStart"] != "22:00" || m["quietEnd"] != "07:00" {
+		t.Errorf("Expected the fields left out to keep their values. Got '%v'", m)
+	}
+
+	payload = []byte(`{"quietStart":"","quietEnd":""}`)
+
+	req, _ = http.NewRequest("PUT", "/users/me", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	m = nil
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if _, ok := m["quietStart"]; ok || m["number"] != "15551234567" || m["timezone"] != "UTC" {
+		t.Errorf("Expected only the quiet hours to be cleared. Got '%v'", m)
+	}
+}
+
+// Test that deferred alerts are sent as one digest per owner once due
+func TestFlushDeferred(t *testing.T) {
+	clearTable("users")
+	clearTable("events")
+
+	now := time.Now().UTC()
+	profiles := map[string]string{
+		// due: the oldest alert is older than an hour
+		"digest@email.com": `{"number":"15551234567","digest":"hourly"}`,
+		// in quiet hours until an hour from now
+		"quiet@email.com": fmt.Sprintf(`{"number":"15551234568","quietStart":"%s","quietEnd":"%s"}`,
+			now.Add(-time.Hour).Format("15:04"), now.Add(time.Hour).Format("15:04")),
+		// not due: the oldest alert is younger than a day
+		"daily@email.com": `{"number":"15551234569","digest":"daily"}`,
+	}
+	for email, profile := range profiles {
+		req, _ := http.NewRequest("PUT", "/users/me", bytes.NewBufferString(profile))
+		req.Header.Set("authorization", loginAs(email))
+		checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+	}
+
+	for _, e := range []struct {
+		owner   string
+		message string
+		age     time.Duration
+	}{
+		{"digest@email.com", "ETH above 4000", 90 * time.Minute},
+		{"digest@email.com", "BTC above 70000", 30 * time.Minute},
+		{"quiet@email.com", "ETH above 4000", 3 * time.Hour},
+		{"daily@email.com", "ETH above 4000", 2 * time.Hour},
+	} {
+		a.DB.Exec(`INSERT INTO alert_events(sub_id, owner, token, quote, rule, price, message, status, created_at)
+			VALUES(1, $1, 'ETH', 'USD', 'max', 4000, $2, 'deferred', $3)`, e.owner, e.message, now.Add(-e.age))
+	}
+
+	if err := a.FlushDeferred(); err != nil {
+		t.Fatal(err)
+	}
+
+	statuses := map[string]string{}
+	rows, _ := a.DB.Query("SELECT owner, string_agg(DISTINCT status, ',') FROM alert_events GROUP BY owner")
+	for rows.Next() {
+		var owner, status string
+		rows.Scan(&owner, &status)
+		statuses[owner] = status
+	}
+	rows.Close()
+
+	expected := map[string]string{"digest@email.com": "pending", "quiet@email.com": "deferred", "daily@email.com": "deferred"}
+	for owner, status := range expected {
+		if statuses[owner] != status {
+			t.Errorf("Expected the alerts of %s to be %s. Got '%s'", owner, status, statuses[owner])
+		}
+	}
+
+	var n, ids int
+	var owner, recipient, message string
+	a.DB.QueryRow("SELECT COUNT(*) FROM outbox").Scan(&n)
+	a.DB.QueryRow("SELECT owner, recipient, message, cardinality(event_ids) FROM outbox").Scan(&owner, &recipient, &message, &ids)
+
+	if n != 1 || owner != "digest@email.com" || recipient != "15551234567" || ids != 2 {
+		t.Fatalf("Expected one digest of 2 alerts to digest@email.com. Got %d deliveries, the first to %s (%s) for %d alerts", n, owner, recipient, ids)
+	}
+	if !strings.HasPrefix(message, "2 alerts since ") || !strings.Contains(message, "- ETH above 4000\n- BTC above 70000") {
+		t.Errorf("Expected the digest to list both alerts oldest first. Got %q", message)
+	}
 }
 
 // Test Empty Table
@@ -138,13 +317,6 @@ func TestGetSub(t *testing.T) {
 	checkResponseCode(t, http.StatusOK, response.Code)
 }
 
-func addUser() {
-	email := "test@email.com"
-	password := "mysecurepassword123"
-
-	a.DB.Exec("INSERT INTO users(email, password) VALUES($1, $2)", email, password)
-}
-
 func addProducts(count int) {
 	if count < 1 {
 		count = 1
@@ -153,24 +325,59 @@ func addProducts(count int) {
 	tokens := [5]string{"DGB", "SC", "ETH", "BTC", "ICN"}
 
 	for i := 0; i < count; i++ {
-		a.DB.Exec("INSERT INTO subs(token, percent, minval, maxval, minmaxchange) VALUES($1, $2, $3, $4, $5)", tokens[i%5], 10, (i+1.0)*20, (i+1.0)*30, 10)
+		a.DB.Exec("INSERT INTO subs(token, percent, minval, maxval, minmaxchange, owner) VALUES($1, $2, $3, $4, $5, $6)", tokens[i%5], 10, (i+1.0)*20, (i+1.0)*30, 10, "test@email.com")
 	}
 }
 
-// Test to get a single sub by token name
+// Test to get the subs for a token name
 func TestGetSubByToken(t *testing.T) {
 	clearTable("subs")
-	addProducts(5)
+	addProducts(10)
 
 	req, _ := http.NewRequest("GET", "/subscriptions/DGB", nil)
+	req.Header.Set("authorization", loginTestUser())
 	response := httptest.NewRecorder()
 	a.Router.ServeHTTP(response, req)
 
-	var m map[string]interface{}
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	if len(m) != 2 {
+		t.Fatalf("Expected 2 subscriptions for 'DGB'. Got %d", len(m))
+	}
+
+	for _, s := range m {
+		if s["token"] != "DGB" {
+			t.Errorf("Expected the token to be 'DGB'. Got '%v'", s["token"])
+		}
+		if s["id"] == nil || s["id"] == 0.0 {
+			t.Errorf("Expected the subscription id to be set. Got '%v'", s["id"])
+		}
+	}
+}
+
+// Test to get the subs for several case insensitive token names
+func TestGetSubByTokenList(t *testing.T) {
+	clearTable("subs")
+	addProducts(5)
+
+	req, _ := http.NewRequest("GET", "/subscriptions/eth,Btc,ETH", nil)
+	req.Header.Set("authorization", loginTestUser())
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
 	json.Unmarshal(response.Body.Bytes(), &m)
 
-	if m["token"] != "DGB" {
-		t.Errorf("Expected the token to be 'DGB'. Got '%v'", m["token"])
+	if len(m) != 2 {
+		t.Fatalf("Expected 2 subscriptions for 'ETH' and 'BTC'. Got %d", len(m))
+	}
+
+	if m[0]["token"] != "BTC" || m[1]["token"] != "ETH" {
+		t.Errorf("Expected the tokens 'BTC' and 'ETH'. Got '%v' and '%v'", m[0]["token"], m[1]["token"])
 	}
 }
 
@@ -246,51 +453,1349 @@ func TestDeleteSub(t *testing.T) {
 	checkResponseCode(t, http.StatusNotFound, response.Code)
 }
 
-func checkResponseCode(t *testing.T, expected, actual int) {
-	if expected != actual {
-		t.Errorf("Expected response code %d. Got %d\n", expected, actual)
+// Test paging through subscriptions with a cursor
+func TestGetSubsPaginated(t *testing.T) {
+	clearTable("subs")
+	addProducts(15)
+	token := loginTestUser()
+
+	req, _ := http.NewRequest("GET", "/subscriptions?count=10&sort=-minVal", nil)
+	req.Header.Set("authorization", token)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if total := response.Header().Get("X-Total-Count"); total != "15" {
+		t.Errorf("Expected X-Total-Count to be '15'. Got '%s'", total)
+	}
+
+	var page []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &page)
+	if len(page) != 10 {
+		t.Fatalf("Expected 10 subscriptions on the first page. Got %d", len(page))
+	}
+	if page[0]["minVal"] != 300.0 {
+		t.Errorf("Expected the first subscription to have the highest minVal '300'. Got '%v'", page[0]["minVal"])
+	}
+
+	link := response.Header().Get("Link")
+	if !strings.HasSuffix(link, `>; rel="next"`) {
+		t.Fatalf("Expected a next link. Got '%s'", link)
+	}
+	next := strings.TrimSuffix(strings.TrimPrefix(link, "<"), `>; rel="next"`)
+
+	req, _ = http.NewRequest("GET", next, nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	page = nil
+	json.Unmarshal(response.Body.Bytes(), &page)
+	if len(page) != 5 {
+		t.Errorf("Expected 5 subscriptions on the last page. Got %d", len(page))
+	}
+	if link := response.Header().Get("Link"); link != "" {
+		t.Errorf("Expected no next link on the last page. Got '%s'", link)
+	}
+
+	// the cursor holds a minVal, it cannot continue a listing by token
+	req, _ = http.NewRequest("GET", strings.Replace(next, "sort=-minVal", "sort=token", 1), nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["error"] != "Invalid cursor" {
+		t.Errorf("Expected the 'error' key of the response to be set to 'Invalid cursor'. Got '%s'", m["error"])
 	}
 }
 
-const subscriptionTableCreationQuery = `CREATE TABLE IF NOT EXISTS subs
-(
-	id SERIAL PRIMARY KEY,
-	token VARCHAR(30) NOT NULL,
-	percent NUMERIC(10,2) NOT NULL DEFAULT 0,
-	minval NUMERIC(10,2) NOT NULL DEFAULT 0,
-	maxval NUMERIC(10,2) NOT NULL DEFAULT 0,
-	minmaxchange NUMERIC(10,2) NOT NULL DEFAULT 0,
-	active BOOLEAN DEFAULT FALSE
-)`
+// Test rejecting an unknown sort field
+func TestGetSubsInvalidSort(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/subscriptions?sort=owner", nil)
+	req.Header.Set("authorization", loginTestUser())
+	response := executeRequest(req)
 
-const userTableCreationQuery = `CREATE TABLE IF NOT EXISTS users
-(
-	id SERIAL PRIMARY KEY,
-	email TEXT NOT NULL,
-	password TEXT NOT NULL
-)`
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
 
-func ensureTableExists() {
-	if _, err := a.DB.Exec(subscriptionTableCreationQuery); err != nil {
-		log.Fatal(err)
+// Test importing subscriptions from CSV and exporting them again
+func TestImportExportSubs(t *testing.T) {
+	clearTable("subs")
+	token := loginTestUser()
+
+	payload := []byte("token,percent,minVal,maxVal,minMaxChange,active\neth,10,220,400,10,true\nBTC,5,0,0,0,false\n")
+
+	req, _ := http.NewRequest("POST", "/subscriptions/import", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	req.Header.Set("Content-Type", "text/csv")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("GET", "/subscriptions/export?format=json", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if len(m) != 2 {
+		t.Fatalf("Expected 2 exported subscriptions. Got %d", len(m))
 	}
-	if _, err := a.DB.Exec(userTableCreationQuery); err != nil {
-		log.Fatal(err)
+	if m[0]["token"] != "ETH" || m[0]["active"] != true {
+		t.Errorf("Expected the first subscription to be an active 'ETH' subscription. Got '%v'", m[0])
+	}
+
+	req, _ = http.NewRequest("GET", "/subscriptions/export?format=csv", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if lines := strings.Count(response.Body.String(), "\n"); lines != 3 {
+		t.Errorf("Expected a header and 2 CSV rows. Got %d lines", lines)
 	}
 }
 
-func clearTable(table string) {
-	switch table {
-	case "users":
-		a.DB.Exec("DELETE from users")
-		a.DB.Exec("ALTER SEQUENCE users_id_seq RESTART WITH 1")
-	case "subs":
-		a.DB.Exec("DELETE from subs")
-		a.DB.Exec("ALTER SEQUENCE subs_id_seq RESTART WITH 1")
-	default:
-		a.DB.Exec("DELETE from subs")
-		a.DB.Exec("ALTER SEQUENCE subs_id_seq RESTART WITH 1")
-		a.DB.Exec("DELETE from users")
-		a.DB.Exec("ALTER SEQUENCE users_id_seq RESTART WITH 1")
+// Test that an import with an invalid row stores nothing
+func TestImportSubsInvalidRow(t *testing.T) {
+	clearTable("subs")
+	token := loginTestUser()
+
+	payload := []byte(`[{"token":"ETH","percent":10},{"token":"","percent":5},{"token":"BTC","minVal":50,"maxVal":10}]`)
+
+	req, _ := http.NewRequest("POST", "/subscriptions/import", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusUnprocessableEntity, response.Code)
+
+	var results []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &results)
+	if len(results) != 3 || results[0]["error"] != nil || results[1]["error"] == nil || results[2]["error"] == nil {
+		t.Errorf("Expected rows 2 and 3 to be rejected. Got '%v'", results)
+	}
+
+	req, _ = http.NewRequest("GET", "/subscriptions", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	if total := response.Header().Get("X-Total-Count"); total != "0" {
+		t.Errorf("Expected no subscriptions to be stored. Got %s", total)
+	}
+}
+
+// Test listing the asset catalog
+func TestGetAssets(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/assets", nil)
+	req.Header.Set("authorization", loginTestUser())
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if len(m) == 0 {
+		t.Fatal("Expected the seeded assets to be listed")
+	}
+
+	req, _ = http.NewRequest("GET", "/assets/eth", nil)
+	req.Header.Set("authorization", loginTestUser())
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var as map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &as)
+	if as["symbol"] != "ETH" {
+		t.Errorf("Expected the 'symbol' key of the response to be set to 'ETH'. Got '%v'", as["symbol"])
+	}
+}
+
+// Test creating a subscription for a token missing from the catalog
+func TestCreateSubUnknownToken(t *testing.T) {
+	clearTable("subs")
+
+	payload := []byte(`{"token":"ETHH","percent":10}`)
+
+	req, _ := http.NewRequest("POST", "/subscriptions", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", loginTestUser())
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["error"] != `unknown token "ETHH"` {
+		t.Errorf("Expected the 'error' key of the response to be set to 'unknown token \"ETHH\"'. Got '%s'", m["error"])
+	}
+
+	addProducts(1)
+	response = putTestSub(loginTestUser(), 1, string(payload))
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	m = nil
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["error"] != `unknown token "ETHH"` {
+		t.Errorf("Expected the update to be rejected with 'unknown token \"ETHH\"'. Got '%s'", m["error"])
+	}
+}
+
+// putTestSub updates subscription id with payload
+func putTestSub(token string, id int, payload string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("PUT", fmt.Sprintf("/subscriptions/%d", id), bytes.NewBufferString(payload))
+	req.Header.Set("authorization", token)
+	return executeRequest(req)
+}
+
+// Test creating subscriptions quoted in other currencies
+func TestCreateSubQuote(t *testing.T) {
+	clearTable("subs")
+	token := loginTestUser()
+
+	payload := []byte(`{"token":"ETH","quote":"eur","maxVal":4000}`)
+
+	req, _ := http.NewRequest("POST", "/subscriptions", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["quote"] != "EUR" {
+		t.Errorf("Expected the 'quote' key of the response to be set to 'EUR'. Got '%v'", m["quote"])
+	}
+
+	payload = []byte(`{"token":"ETH","quote":"JPY","maxVal":4000}`)
+
+	req, _ = http.NewRequest("POST", "/subscriptions", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	response = putTestSub(token, 1, string(payload))
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+// Test deriving the price of a pair from the quotes of a round
+func TestQuoteRate(t *testing.T) {
+	quotes := []main.Quote{
+		{Token: "ETH", Quote: "USD", Price: 3000},
+		{Token: "BTC", Quote: "USD", Price: 60000},
+		{Token: "BTC", Quote: "EUR", Price: 55000},
+		{Token: "ADA", Quote: "BTC", Price: 0.00001},
+	}
+
+	cases := []struct {
+		token, quote string
+		expected     float64
+		ok           bool
+	}{
+		{"ETH", "USD", 3000, true},
+		{"USD", "BTC", 1.0 / 60000, true},
+		{"ETH", "BTC", 0.05, true},
+		{"ADA", "EUR", 0.55, true},
+		{"ETH", "ETH", 1, true},
+		{"ETH", "JPY", 0, false},
+		{"XRP", "USD", 0, false},
+	}
+
+	for _, c := range cases {
+		price, ok := main.QuoteRate(quotes, c.token, c.quote)
+		if ok != c.ok || math.Abs(price-c.expected) > 1e-9*c.expected {
+			t.Errorf("Expected %s/%s to be %v (%v). Got %v (%v)", c.token, c.quote, c.expected, c.ok, price, ok)
+		}
+	}
+}
+
+// Test that a threshold is compared with the price in the subscription's
+// quote currency
+func TestAlertInQuoteCurrency(t *testing.T) {
+	clearTable("subs")
+	clearTable("events")
+	clearTable("prices")
+	token := loginTestUser()
+
+	payload := []byte(`{"token":"ETH","quote":"EUR","maxVal":2800}`)
+	req, _ := http.NewRequest("POST", "/subscriptions", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+
+	// ETH/EUR is only known through BTC: 2750 EUR, then 2860 EUR. In USD
+	// ETH is above 2800 all along, so it would never cross.
+	round := func(ethBTC float64) []main.Quote {
+		return []main.Quote{
+			{Token: "ETH", Quote: "BTC", Price: ethBTC},
+			{Token: "BTC", Quote: "EUR", Price: 55000},
+			{Token: "BTC", Quote: "USD", Price: 60000},
+		}
+	}
+	if err := a.WatchRounds(round(0.05), round(0.052)); err != nil {
+		t.Fatal(err)
+	}
+
+	var rule, quote string
+	var price float64
+	err := a.DB.QueryRow("SELECT rule, quote, price FROM alert_events WHERE sub_id=1").Scan(&rule, &quote, &price)
+	if err != nil {
+		t.Fatalf("Expected the max threshold to fire. Got '%v'", err)
+	}
+	if rule != "max" || quote != "EUR" || math.Abs(price-2860) > 1e-6 {
+		t.Errorf("Expected a max alert at 2860 EUR. Got %s at %v %s", rule, price, quote)
+	}
+}
+
+// Test aggregating stored prices into candles
+func TestGetPrices(t *testing.T) {
+	clearTable("prices")
+
+	samples := []struct {
+		ts    string
+		price float64
+	}{
+		{"2018-01-01T10:05:00Z", 700},
+		{"2018-01-01T10:20:00Z", 750},
+		{"2018-01-01T10:40:00Z", 690},
+		{"2018-01-01T10:55:00Z", 720},
+		{"2018-01-01T11:10:00Z", 730},
+	}
+	for _, p := range samples {
+		a.DB.Exec("INSERT INTO prices(token, quote, price, source, ts) VALUES('ETH', 'USD', $1, 'test', $2)", p.price, p.ts)
+	}
+
+	req, _ := http.NewRequest("GET", "/prices/eth?quote=USD&interval=1h&from=2018-01-01T10:00:00Z&to=2018-01-01T12:00:00Z", nil)
+	req.Header.Set("authorization", loginTestUser())
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var candles []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &candles)
+	if len(candles) != 2 {
+		t.Fatalf("Expected 2 hourly candles. Got %d", len(candles))
+	}
+
+	first := candles[0]
+	if first["open"] != 700.0 || first["high"] != 750.0 || first["low"] != 690.0 || first["close"] != 720.0 {
+		t.Errorf("Expected the first candle to be 700/750/690/720. Got '%v'", first)
+	}
+	if first["time"] != "2018-01-01T10:00:00Z" {
+		t.Errorf("Expected the first candle to start at 10:00. Got '%v'", first["time"])
+	}
+}
+
+// Test listing the alert events of the caller and of one subscription
+func TestGetEvents(t *testing.T) {
+	clearTable("subs")
+	clearTable("events")
+	addProducts(2)
+	token := loginTestUser()
+
+	for i := 0; i < 3; i++ {
+		a.DB.Exec("INSERT INTO alert_events(sub_id, owner, token, quote, rule, price) VALUES($1, $2, 'DGB', 'USD', 'percent', 1)", 1, "test@email.com")
+	}
+	a.DB.Exec("INSERT INTO alert_events(sub_id, owner, token, quote, rule, price) VALUES($1, $2, 'SC', 'USD', 'max', 1)", 2, "test@email.com")
+	a.DB.Exec("INSERT INTO alert_events(sub_id, owner, token, quote, rule, price) VALUES($1, $2, 'SC', 'USD', 'max', 1)", 2, "someone@else.com")
+
+	req, _ := http.NewRequest("GET", "/events?count=3", nil)
+	req.Header.Set("authorization", token)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var events []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &events)
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events on the first page. Got %d", len(events))
+	}
+	if events[0]["id"] != 4.0 {
+		t.Errorf("Expected the newest of the caller's events first. Got '%v'", events[0]["id"])
+	}
+	if response.Header().Get("Link") == "" {
+		t.Error("Expected a next link")
+	}
+
+	req, _ = http.NewRequest("GET", "/subscriptions/1/events", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	events = nil
+	json.Unmarshal(response.Body.Bytes(), &events)
+	if len(events) != 3 {
+		t.Errorf("Expected 3 events for subscription 1. Got %d", len(events))
+	}
+
+	req, _ = http.NewRequest("GET", "/subscriptions/99/events", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+// Test authenticating the WebSocket stream
+func TestWebSocketAuth(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/ws", nil)
+	response := executeRequest(req)
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	req, _ = http.NewRequest("GET", "/ws?token=invalid", nil)
+	response = executeRequest(req)
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?token=" + loginTestUser()
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatalf("Expected to connect with a valid token. Got '%v'", err)
+	}
+	defer conn.Close()
+
+	if err := conn.WriteJSON(map[string]interface{}{"action": "subscribe", "tokens": []string{"ETH"}}); err != nil {
+		t.Errorf("Expected to subscribe to ticks. Got '%v'", err)
+	}
+}
+
+// Test that WebSockets are only opened from the origins allowed by CORS
+func TestWebSocketOrigin(t *testing.T) {
+	a.CORS = main.CORS{AllowedOrigins: []string{"http://localhost:4200"}}
+	defer func() { a.CORS = main.CORS{} }()
+
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/ws?token=" + loginTestUser()
+
+	conn, _, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://localhost:4200"}})
+	if err != nil {
+		t.Fatalf("Expected to connect from an allowed origin. Got '%v'", err)
+	}
+	conn.Close()
+
+	_, resp, err := websocket.DefaultDialer.Dial(url, http.Header{"Origin": {"http://evil.example"}})
+	if err == nil {
+		t.Fatal("Expected the connection from another origin to be refused")
+	}
+	checkResponseCode(t, http.StatusForbidden, resp.StatusCode)
+}
+
+// Test resuming the event stream from a Last-Event-ID
+func TestEventStreamResume(t *testing.T) {
+	clearTable("subs")
+	clearTable("events")
+	token := loginTestUser()
+
+	payload := []byte(`{"token":"ETH","percent":10}`)
+	req, _ := http.NewRequest("POST", "/subscriptions", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+
+	req, _ = http.NewRequest("GET", server.URL+"/events/stream", nil)
+	req.Header.Set("authorization", token)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	checkResponseCode(t, http.StatusOK, resp.StatusCode)
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected the Content-Type to be 'text/event-stream'. Got '%s'", ct)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		if scanner.Text() == "event: subscription.created" {
+			return
+		}
+	}
+	t.Error("Expected the missed subscription.created event to be replayed")
+}
+
+// Test that the same crossing is recorded once, but crossing again is not a
+// duplicate
+func TestAlertDedup(t *testing.T) {
+	clearTable("subs")
+	clearTable("events")
+	token := loginTestUser()
+
+	payload := []byte(`{"token":"ETH","maxVal":400}`)
+	req, _ := http.NewRequest("POST", "/subscriptions", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+
+	countEvents := func() int {
+		var n int
+		a.DB.QueryRow("SELECT COUNT(*) FROM alert_events WHERE sub_id=1").Scan(&n)
+		return n
+	}
+
+	// the same crossing seen twice at slightly different prices
+	a.FireAlert("test@email.com", 1, "max", 401, 390, time.Hour)
+	a.FireAlert("test@email.com", 1, "max", 402.5, 390, time.Hour)
+	if n := countEvents(); n != 1 {
+		t.Errorf("Expected the second alert of the crossing to be dropped. Got %d events", n)
+	}
+
+	// the price fell back and crossed again
+	a.FireAlert("test@email.com", 1, "max", 401, 395, time.Hour)
+	if n := countEvents(); n != 2 {
+		t.Errorf("Expected the new crossing to be recorded. Got %d events", n)
+	}
+
+	a.FireAlert("test@email.com", 1, "max", 401, 390, 0)
+	if n := countEvents(); n != 3 {
+		t.Errorf("Expected nothing to be dropped without a dedup window. Got %d events", n)
+	}
+}
+
+// Test that a daily limit of zero allows no messages
+func TestReserveNotificationZeroLimit(t *testing.T) {
+	ok, err := main.ReserveNotification(a.DB, "test@email.com", "sms", "2024-01-01", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok {
+		t.Error("Expected no message to be allowed with a limit of 0")
+	}
+}
+
+// Test that a replay cut off at the limit is signalled
+func TestEventStreamTruncated(t *testing.T) {
+	clearTable("events")
+	token := loginTestUser()
+
+	a.DB.Exec(`INSERT INTO user_events(owner, type, data)
+		SELECT 'test@email.com', 'subscription.deleted', '{}' FROM generate_series(1, 1001)`)
+
+	server := httptest.NewServer(a.Router)
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/events/stream", nil)
+	req.Header.Set("authorization", token)
+	req.Header.Set("Last-Event-ID", "0")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	replayed := 0
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		switch scanner.Text() {
+		case "event: subscription.deleted":
+			replayed++
+		case "event: truncated":
+			if replayed != 1000 {
+				t.Errorf("Expected 1000 replayed events before the cut. Got %d", replayed)
+			}
+			return
+		}
+	}
+	t.Error("Expected a truncated event after the replay limit")
+}
+
+// Test creating subscriptions with a condition expression
+func TestCreateSubCondition(t *testing.T) {
+	clearTable("subs")
+	token := loginTestUser()
+
+	payload := []byte(`{"token":"ETH","condition":"price(ETH) > 3000 AND change_24h(ETH) < -5%"}`)
+
+	req, _ := http.NewRequest("POST", "/subscriptions", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["condition"] != "price(ETH) > 3000 AND change_24h(ETH) < -5%" {
+		t.Errorf("Expected the 'condition' key of the response to be set. Got '%v'", m["condition"])
+	}
+
+	invalid := map[string]string{
+		`price(ETH) / price(BTC) <`:                  "invalid condition at column 26: unexpected \"end of condition\"",
+		`price(ETH) > 3000 AND change_24h(ETH) < -5`: "invalid condition at column 39: cannot compare a percentage with a number, write percentages like -5%",
+		`price(ETHH) > 1`:                            `unknown token "ETHH"`,
+	}
+	for condition, expected := range invalid {
+		payload, _ := json.Marshal(map[string]string{"token": "ETH", "condition": condition})
+
+		req, _ := http.NewRequest("POST", "/subscriptions", bytes.NewBuffer(payload))
+		req.Header.Set("authorization", token)
+		response := executeRequest(req)
+
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+		var m map[string]string
+		json.Unmarshal(response.Body.Bytes(), &m)
+		if m["error"] != expected {
+			t.Errorf("Expected the 'error' key of the response to be set to '%s'. Got '%s'", expected, m["error"])
+		}
+
+		response = putTestSub(token, 1, string(payload))
+
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+		m = nil
+		json.Unmarshal(response.Body.Bytes(), &m)
+		if m["error"] != expected {
+			t.Errorf("Expected the update to be rejected with '%s'. Got '%s'", expected, m["error"])
+		}
+	}
+}
+
+// Test creating subscriptions with a lookback window
+func TestCreateSubWindow(t *testing.T) {
+	clearTable("subs")
+	token := loginTestUser()
+
+	payload := []byte(`{"token":"BTC","percent":5,"window":"24H"}`)
+
+	req, _ := http.NewRequest("POST", "/subscriptions", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["window"] != "24h" {
+		t.Errorf("Expected the 'window' key of the response to be set to '24h'. Got '%v'", m["window"])
+	}
+
+	for _, payload := range []string{`{"token":"BTC","percent":5,"window":"2h"}`, `{"token":"BTC","window":"1h"}`} {
+		req, _ := http.NewRequest("POST", "/subscriptions", bytes.NewBufferString(payload))
+		req.Header.Set("authorization", token)
+		response := executeRequest(req)
+
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+		response = putTestSub(token, 1, payload)
+
+		checkResponseCode(t, http.StatusBadRequest, response.Code)
+	}
+}
+
+// Test that a windowed percent change is not measured across a gap in the
+// price history
+func TestWindowAlertHistoryGap(t *testing.T) {
+	// the closest prices are 40 and 50 minutes away from the start of the
+	// window, more than the 10 minutes tolerated for 1h
+	if n := runWindowAlert(t, -110*time.Minute, -20*time.Minute); n != 0 {
+		t.Errorf("Expected no alert without a price near the start of the window. Got %d", n)
+	}
+}
+
+// Test that a windowed percent change fires with history near the start of
+// the window
+func TestWindowAlertHistory(t *testing.T) {
+	if n := runWindowAlert(t, -65*time.Minute, -20*time.Minute); n != 1 {
+		t.Errorf("Expected the 10%% change over the window to fire. Got %d alerts", n)
+	}
+}
+
+// Test that old raw prices are rolled up into hourly rows keeping the last
+// price of the hour, and that prices past the maximum retention are deleted
+func TestPrunePrices(t *testing.T) {
+	clearTable("prices")
+
+	now := time.Now()
+	hour := now.Truncate(time.Hour)
+	for _, p := range []struct {
+		price      float64
+		resolution int
+		ts         time.Time
+	}{
+		// raw, older than the raw retention: rolled up
+		{100, 0, hour.Add(-48*time.Hour + 10*time.Minute)},
+		{110, 0, hour.Add(-48*time.Hour + 50*time.Minute)},
+		// raw and rolled up, older than the maximum retention: deleted
+		{50, 0, hour.Add(-96*time.Hour + 10*time.Minute)},
+		{60, 3600, hour.Add(-100 * time.Hour)},
+		// raw, recent: kept
+		{120, 0, now.Add(-time.Hour)},
+	} {
+		a.DB.Exec("INSERT INTO prices(token, quote, price, source, resolution, ts) VALUES('ETH', 'USD', $1, 'test', $2, $3)",
+			p.price, p.resolution, p.ts)
+	}
+
+	if err := a.PrunePrices(24*time.Hour, 72*time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	type row struct {
+		price      float64
+		resolution int
+		ts         time.Time
+	}
+	var got []row
+	rows, err := a.DB.Query("SELECT price, resolution, ts FROM prices ORDER BY ts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var r row
+		rows.Scan(&r.price, &r.resolution, &r.ts)
+		got = append(got, r)
+	}
+	rows.Close()
+
+	expected := []row{
+		{110, 3600, hour.Add(-48 * time.Hour)},
+		{120, 0, now.Add(-time.Hour)},
+	}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d prices to remain. Got %v", len(expected), got)
+	}
+	for i, e := range expected {
+		if got[i].price != e.price || got[i].resolution != e.resolution || !got[i].ts.Equal(e.ts.Truncate(time.Microsecond)) {
+			t.Errorf("Expected price %d to be %v. Got %v", i, e, got[i])
+		}
+	}
+}
+
+// runWindowAlert stores an ETH price of 3000 at each offset from now, runs a
+// polling round at 3300 for a subscription to 5% over 1h and returns the
+// number of alerts recorded
+func runWindowAlert(t *testing.T, offsets ...time.Duration) int {
+	clearTable("subs")
+	clearTable("events")
+	clearTable("prices")
+	token := loginTestUser()
+
+	payload := []byte(`{"token":"ETH","percent":5,"window":"1h"}`)
+	req, _ := http.NewRequest("POST", "/subscriptions", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	checkResponseCode(t, http.StatusCreated, executeRequest(req).Code)
+
+	for _, offset := range offsets {
+		a.DB.Exec("INSERT INTO prices(token, quote, price, source, ts) VALUES('ETH', 'USD', 3000, 'test', $1)", time.Now().Add(offset))
+	}
+
+	if err := a.WatchRounds([]main.Quote{{Token: "ETH", Quote: "USD", Price: 3300}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	a.DB.QueryRow("SELECT COUNT(*) FROM alert_events WHERE sub_id=1 AND rule='percent'").Scan(&n)
+	return n
+}
+
+// loginTestUser registers the test user if needed and returns a fresh token
+func loginTestUser() string {
+	return loginAs("test@email.com")
+}
+
+// loginAs registers a user with email if needed and returns a fresh token
+func loginAs(email string) string {
+	payload := []byte(`{"email":"` + email + `","password":"mysecurepassword123"}`)
+
+	req, _ := http.NewRequest("POST", "/users/register", bytes.NewBuffer(payload))
+	executeRequest(req)
+
+	req, _ = http.NewRequest("POST", "/users/login", bytes.NewBuffer(payload))
+	response := executeRequest(req)
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+
+	return m["token"]
+}
+
+func checkResponseCode(t *testing.T, expected, actual int) {
+	if expected != actual {
+		t.Errorf("Expected response code %d. Got %d\n", expected, actual)
+	}
+}
+
+const subscriptionTableCreationQuery = `CREATE TABLE IF NOT EXISTS subs
+(
+	id SERIAL PRIMARY KEY,
+	token VARCHAR(30) NOT NULL,
+	quote VARCHAR(10) NOT NULL DEFAULT 'USD',
+	percent NUMERIC(10,2) NOT NULL DEFAULT 0,
+	lookback VARCHAR(10) NOT NULL DEFAULT '',
+	minval NUMERIC(10,2) NOT NULL DEFAULT 0,
+	maxval NUMERIC(10,2) NOT NULL DEFAULT 0,
+	minmaxchange NUMERIC(10,2) NOT NULL DEFAULT 0,
+	condition TEXT NOT NULL DEFAULT '',
+	cooldown INTEGER NOT NULL DEFAULT 0,
+	owner TEXT NOT NULL DEFAULT '',
+	active BOOLEAN DEFAULT FALSE
+)`
+
+const userTableCreationQuery = `CREATE TABLE IF NOT EXISTS users
+(
+	id SERIAL PRIMARY KEY,
+	email TEXT NOT NULL,
+	password TEXT NOT NULL,
+	number TEXT DEFAULT '',
+	timezone TEXT NOT NULL DEFAULT 'UTC',
+	quiet_start TEXT NOT NULL DEFAULT '',
+	quiet_end TEXT NOT NULL DEFAULT '',
+	digest TEXT NOT NULL DEFAULT ''
+)`
+
+const assetTableCreationQuery = `CREATE TABLE IF NOT EXISTS assets
+(
+	symbol VARCHAR(30) PRIMARY KEY,
+	name TEXT NOT NULL DEFAULT '',
+	decimals INTEGER NOT NULL DEFAULT 8,
+	quotes TEXT[] NOT NULL DEFAULT '{USD}',
+	enabled BOOLEAN NOT NULL DEFAULT TRUE
+)`
+
+const priceTableCreationQuery = `CREATE TABLE IF NOT EXISTS prices
+(
+	id BIGSERIAL PRIMARY KEY,
+	token VARCHAR(30) NOT NULL,
+	quote VARCHAR(10) NOT NULL,
+	price NUMERIC(30,10) NOT NULL,
+	volume NUMERIC(30,10) NOT NULL DEFAULT 0,
+	source TEXT NOT NULL,
+	resolution INTEGER NOT NULL DEFAULT 0,
+	ts TIMESTAMPTZ NOT NULL
+)`
+
+const eventTableCreationQuery = `CREATE TABLE IF NOT EXISTS alert_events
+(
+	id BIGSERIAL PRIMARY KEY,
+	sub_id INTEGER NOT NULL,
+	owner TEXT NOT NULL,
+	token VARCHAR(30) NOT NULL,
+	quote VARCHAR(10) NOT NULL,
+	rule TEXT NOT NULL,
+	price NUMERIC(30,10) NOT NULL,
+	baseline NUMERIC(30,10) NOT NULL DEFAULT 0,
+	threshold NUMERIC(30,10) NOT NULL DEFAULT 0,
+	message TEXT NOT NULL DEFAULT '',
+	channel TEXT NOT NULL DEFAULT '',
+	status TEXT NOT NULL DEFAULT 'pending',
+	error TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	delivered_at TIMESTAMPTZ
+)`
+
+const userEventTableCreationQuery = `CREATE TABLE IF NOT EXISTS user_events
+(
+	id BIGSERIAL PRIMARY KEY,
+	owner TEXT NOT NULL,
+	type TEXT NOT NULL,
+	data JSONB NOT NULL,
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+const notificationCountTableCreationQuery = `CREATE TABLE IF NOT EXISTS notification_counts
+(
+	owner TEXT NOT NULL,
+	channel TEXT NOT NULL,
+	day DATE NOT NULL,
+	count INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (owner, channel, day)
+)`
+
+const outboxTableCreationQuery = `CREATE TABLE IF NOT EXISTS outbox
+(
+	id BIGSERIAL PRIMARY KEY,
+	event_ids BIGINT[] NOT NULL DEFAULT '{}',
+	owner TEXT NOT NULL,
+	channel TEXT NOT NULL,
+	recipient TEXT NOT NULL,
+	message TEXT NOT NULL,
+	status TEXT NOT NULL DEFAULT 'pending',
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+	created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+)`
+
+func ensureTableExists() {
+	if _, err := a.DB.Exec(subscriptionTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := a.DB.Exec(userTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := a.DB.Exec(assetTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := a.DB.Exec(priceTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := a.DB.Exec(eventTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := a.DB.Exec(userEventTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := a.DB.Exec(notificationCountTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+	if _, err := a.DB.Exec(outboxTableCreationQuery); err != nil {
+		log.Fatal(err)
+	}
+	if err := a.SeedAssets("assets.json"); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func clearTable(table string) {
+	switch table {
+	case "users":
+		a.DB.Exec("DELETE from users")
+		a.DB.Exec("ALTER SEQUENCE users_id_seq RESTART WITH 1")
+	case "subs":
+		a.DB.Exec("DELETE from subs")
+		a.DB.Exec("ALTER SEQUENCE subs_id_seq RESTART WITH 1")
+	case "prices":
+		a.DB.Exec("DELETE from prices")
+	case "events":
+		a.DB.Exec("DELETE from alert_events")
+		a.DB.Exec("ALTER SEQUENCE alert_events_id_seq RESTART WITH 1")
+		a.DB.Exec("DELETE from user_events")
+		a.DB.Exec("DELETE from notification_counts")
+		a.DB.Exec("DELETE from outbox")
+		a.DB.Exec("ALTER SEQUENCE outbox_id_seq RESTART WITH 1")
+	default:
+		a.DB.Exec("DELETE from outbox")
+		a.DB.Exec("DELETE from notification_counts")
+		a.DB.Exec("DELETE from user_events")
+		a.DB.Exec("DELETE from alert_events")
+		a.DB.Exec("DELETE from prices")
+		a.DB.Exec("DELETE from subs")
+		a.DB.Exec("ALTER SEQUENCE subs_id_seq RESTART WITH 1")
+		a.DB.Exec("DELETE from users")
+		a.DB.Exec("ALTER SEQUENCE users_id_seq RESTART WITH 1")
+	}
+}
+
+// Test creating a subscription with a cooldown
+func TestCreateSubCooldown(t *testing.T) {
+	clearTable("subs")
+	token := loginTestUser()
+
+	payload := []byte(`{"token":"ETH","percent":5,"cooldown":900}`)
+
+	req, _ := http.NewRequest("POST", "/subscriptions", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusCreated, response.Code)
+
+	req, _ = http.NewRequest("GET", "/subscriptions/1", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["cooldown"] != 900.0 {
+		t.Errorf("Expected the 'cooldown' key of the response to be set to '900'. Got '%v'", m["cooldown"])
+	}
+
+	payload = []byte(`{"token":"ETH","percent":5,"cooldown":-1}`)
+
+	req, _ = http.NewRequest("POST", "/subscriptions", bytes.NewBuffer(payload))
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+
+	response = putTestSub(token, 1, string(payload))
+
+	checkResponseCode(t, http.StatusBadRequest, response.Code)
+}
+
+// Test inspecting and requeueing dead-lettered deliveries
+func TestRequeueDelivery(t *testing.T) {
+	clearTable("events")
+	token := loginTestUser()
+
+	a.DB.Exec("INSERT INTO alert_events(sub_id, owner, token, quote, rule, price, status) VALUES(1, 'test@email.com', 'ETH', 'USD', 'max', 1, 'failed')")
+	a.DB.Exec("INSERT INTO outbox(event_ids, owner, channel, recipient, message, status, attempts, last_error) VALUES('{1}', 'test@email.com', 'sms', '15551234567', 'ETH is up', 'dead', 5, 'timeout')")
+
+	a.Admins = nil
+	req, _ := http.NewRequest("GET", "/admin/deliveries?status=dead", nil)
+	req.Header.Set("authorization", token)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusForbidden, response.Code)
+
+	a.Admins = []string{"test@email.com"}
+	defer func() { a.Admins = nil }()
+
+	req, _ = http.NewRequest("GET", "/admin/deliveries?status=dead", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var deliveries []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &deliveries)
+	if len(deliveries) != 1 || deliveries[0]["lastError"] != "timeout" {
+		t.Fatalf("Expected the dead delivery to be listed. Got '%v'", deliveries)
+	}
+
+	req, _ = http.NewRequest("POST", "/admin/deliveries/1/requeue", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["status"] != "pending" || m["attempts"] != 0.0 {
+		t.Errorf("Expected the delivery to be pending with no attempts. Got '%v'", m)
+	}
+
+	var status string
+	a.DB.QueryRow("SELECT status FROM alert_events WHERE id=1").Scan(&status)
+	if status != "pending" {
+		t.Errorf("Expected the event to be pending again. Got '%s'", status)
+	}
+
+	req, _ = http.NewRequest("POST", "/admin/deliveries/1/requeue", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusConflict, response.Code)
+
+	req, _ = http.NewRequest("POST", "/admin/deliveries/99/requeue", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusNotFound, response.Code)
+}
+
+// Test that request ids are echoed or generated
+func TestRequestID(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/assets", nil)
+	req.Header.Set("authorization", loginTestUser())
+	req.Header.Set("X-Request-ID", "test-request-1")
+	response := executeRequest(req)
+
+	if id := response.Header().Get("X-Request-ID"); id != "test-request-1" {
+		t.Errorf("Expected the request id to be echoed. Got '%s'", id)
+	}
+
+	req, _ = http.NewRequest("GET", "/assets", nil)
+	req.Header.Set("authorization", loginTestUser())
+	response = executeRequest(req)
+
+	if id := response.Header().Get("X-Request-ID"); len(id) != 32 {
+		t.Errorf("Expected a generated request id. Got '%s'", id)
+	}
+}
+
+// Test the Prometheus metrics endpoint
+func TestMetrics(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/assets", nil)
+	req.Header.Set("authorization", loginTestUser())
+	executeRequest(req)
+
+	req, _ = http.NewRequest("GET", "/metrics", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	if body := response.Body.String(); !strings.Contains(body, `http_requests_total{code="200",method="GET",route="/assets"}`) {
+		t.Errorf("Expected the request to /assets to be counted. Got '%s'", body)
+	}
+}
+
+// Test the liveness and readiness probes
+func TestHealth(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/healthz", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	req, _ = http.NewRequest("GET", "/readyz", nil)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m struct {
+		Status string
+		Checks map[string]struct {
+			Status string
+		}
+	}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m.Status != "ok" || m.Checks["database"].Status != "ok" {
+		t.Errorf("Expected the database check to pass. Got '%v'", m)
+	}
+	if _, ok := m.Checks["prices"]; !ok {
+		t.Errorf("Expected a prices check. Got '%v'", m.Checks)
+	}
+}
+
+// Test that login attempts are throttled per client IP
+func TestRateLimit(t *testing.T) {
+	token := loginTestUser()
+	a.RateLimits = map[string]main.RateLimit{"auth": {Requests: 2, Per: time.Minute}}
+	defer func() { a.RateLimits = nil }()
+
+	payload := []byte(`{"email":"test@email.com","password":"mysecurepassword123"}`)
+	login := func(ip string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/users/login", bytes.NewBuffer(payload))
+		req.RemoteAddr = ip + ":1234"
+		return executeRequest(req)
+	}
+
+	for i := 0; i < 2; i++ {
+		checkResponseCode(t, http.StatusOK, login("192.0.2.10").Code)
+	}
+
+	response := login("192.0.2.10")
+	checkResponseCode(t, http.StatusTooManyRequests, response.Code)
+	if retry := response.Header().Get("Retry-After"); retry != "30" {
+		t.Errorf("Expected to retry after 30 seconds. Got '%s'", retry)
+	}
+	if remaining := response.Header().Get("X-RateLimit-Remaining"); remaining != "0" {
+		t.Errorf("Expected no remaining requests. Got '%s'", remaining)
+	}
+
+	// other clients and the authenticated routes are not affected
+	checkResponseCode(t, http.StatusOK, login("192.0.2.11").Code)
+
+	req, _ := http.NewRequest("GET", "/assets", nil)
+	req.Header.Set("authorization", token)
+	req.RemoteAddr = "192.0.2.10:1234"
+	checkResponseCode(t, http.StatusOK, executeRequest(req).Code)
+}
+
+// Test that preflight requests of allowed origins are answered before auth
+func TestCORS(t *testing.T) {
+	a.CORS = main.CORS{
+		AllowedOrigins: []string{"http://localhost:4200"},
+		AllowedMethods: []string{"GET", "POST", "PUT", "DELETE"},
+		AllowedHeaders: []string{"Authorization", "Content-Type"},
+		MaxAge:         600,
+	}
+	defer func() { a.CORS = main.CORS{} }()
+
+	req, _ := http.NewRequest("OPTIONS", "/subscriptions", nil)
+	req.Header.Set("Origin", "http://localhost:4200")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	req.Header.Set("Access-Control-Request-Headers", "authorization,content-type")
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusNoContent, response.Code)
+	if origin := response.Header().Get("Access-Control-Allow-Origin"); origin != "http://localhost:4200" {
+		t.Errorf("Expected the origin to be allowed. Got '%s'", origin)
+	}
+	if methods := response.Header().Get("Access-Control-Allow-Methods"); !strings.Contains(methods, "POST") {
+		t.Errorf("Expected POST to be allowed. Got '%s'", methods)
+	}
+
+	req, _ = http.NewRequest("GET", "/assets", nil)
+	req.Header.Set("Origin", "http://localhost:4200")
+	req.Header.Set("authorization", loginTestUser())
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if origin := response.Header().Get("Access-Control-Allow-Origin"); origin != "http://localhost:4200" {
+		t.Errorf("Expected the origin to be allowed. Got '%s'", origin)
+	}
+
+	req, _ = http.NewRequest("OPTIONS", "/subscriptions", nil)
+	req.Header.Set("Origin", "http://evil.example")
+	req.Header.Set("Access-Control-Request-Method", "POST")
+	response = executeRequest(req)
+
+	if origin := response.Header().Get("Access-Control-Allow-Origin"); origin != "" {
+		t.Errorf("Expected other origins to be refused. Got '%s'", origin)
+	}
+}
+
+// Test that every registered route is described in /openapi.json
+func TestOpenAPICoversRoutes(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/openapi.json", nil)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var spec struct {
+		Paths map[string]map[string]json.RawMessage
+	}
+	if err := json.Unmarshal(response.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("Expected a JSON document. Got %v", err)
+	}
+
+	// compare paths by shape, since mux templates carry patterns and the
+	// spec may name a parameter differently
+	params := regexp.MustCompile(`\{[^}]*\}`)
+	documented := map[string]bool{}
+	for path, item := range spec.Paths {
+		for method := range item {
+			documented[strings.ToUpper(method)+" "+params.ReplaceAllString(path, "{}")] = true
+		}
+	}
+
+	a.Router.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+
+		for _, method := range methods {
+			// preflight requests are answered for every path
+			if method == "OPTIONS" {
+				continue
+			}
+			// the unversioned aliases are documented by their /v1 route
+			key := method + " " + params.ReplaceAllString(tpl, "{}")
+			alias := method + " /v1" + params.ReplaceAllString(tpl, "{}")
+			if !documented[key] && !documented[alias] {
+				t.Errorf("Expected %s %s to be documented in openapi.json", method, tpl)
+			}
+		}
+		return nil
+	})
+}
+
+// Test that the API is served under /v1 and the unversioned routes are
+// deprecated aliases
+func TestVersionedRoutes(t *testing.T) {
+	token := loginTestUser()
+
+	req, _ := http.NewRequest("GET", "/v1/assets", nil)
+	req.Header.Set("authorization", token)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if dep := response.Header().Get("Deprecation"); dep != "" {
+		t.Errorf("Expected /v1 routes not to be deprecated. Got '%s'", dep)
+	}
+
+	req, _ = http.NewRequest("GET", "/assets", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if dep := response.Header().Get("Deprecation"); !strings.HasPrefix(dep, "@") {
+		t.Errorf("Expected a Deprecation date on the unversioned route. Got '%s'", dep)
+	}
+	if sunset := response.Header().Get("Sunset"); sunset == "" {
+		t.Error("Expected a Sunset date on the unversioned route")
+	}
+
+	payload := []byte(`{"email":"test@email.com","password":"mysecurepassword123"}`)
+	req, _ = http.NewRequest("POST", "/v1/users/login", bytes.NewBuffer(payload))
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+}
+
+// Test exchanging a valid token for a new one
+func TestRefreshToken(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/v1/users/refresh", nil)
+	req.Header.Set("authorization", loginTestUser())
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+
+	var m map[string]string
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["email"] != "test@email.com" || m["token"] == "" {
+		t.Errorf("Expected a new token for test@email.com. Got '%v'", m)
+	}
+
+	req, _ = http.NewRequest("POST", "/v1/users/refresh", nil)
+	req.Header.Set("authorization", "not-a-token")
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+
+	// a still valid token of a deleted user is not renewed
+	token := loginAs("gone@email.com")
+	a.DB.Exec("DELETE FROM users WHERE email=$1", "gone@email.com")
+
+	req, _ = http.NewRequest("POST", "/v1/users/refresh", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusUnauthorized, response.Code)
+}
+
+// Test that subscriptions are only visible to and editable by their owner
+func TestSubsOwnership(t *testing.T) {
+	clearTable("subs")
+	addProducts(3)
+	token := loginTestUser()
+	other := loginAs("other@email.com")
+
+	req, _ := http.NewRequest("GET", "/subscriptions", nil)
+	req.Header.Set("authorization", other)
+	response := executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	if total := response.Header().Get("X-Total-Count"); total != "0" {
+		t.Errorf("Expected another user to count no subscriptions. Got %s", total)
+	}
+	var page []map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &page)
+	if len(page) != 0 {
+		t.Errorf("Expected another user to list no subscriptions. Got %d", len(page))
+	}
+
+	requests := []struct {
+		method, path, payload string
+	}{
+		{"GET", "/subscriptions/1", ""},
+		{"GET", "/subscriptions/1/events", ""},
+		{"PUT", "/subscriptions/1", `{"token":"BTC","percent":1}`},
+		{"DELETE", "/subscriptions/1", ""},
+	}
+	for _, r := range requests {
+		req, _ := http.NewRequest(r.method, r.path, bytes.NewBufferString(r.payload))
+		req.Header.Set("authorization", other)
+		response := executeRequest(req)
+
+		if response.Code != http.StatusNotFound {
+			t.Errorf("Expected %s %s by another user to be 404. Got %d", r.method, r.path, response.Code)
+		}
+	}
+
+	req, _ = http.NewRequest("GET", "/subscriptions/1", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	checkResponseCode(t, http.StatusOK, response.Code)
+	var m map[string]interface{}
+	json.Unmarshal(response.Body.Bytes(), &m)
+	if m["token"] != "DGB" || m["percent"] != 10.0 {
+		t.Errorf("Expected the subscription to be unchanged. Got '%v'", m)
+	}
+
+	req, _ = http.NewRequest("GET", "/subscriptions", nil)
+	req.Header.Set("authorization", token)
+	response = executeRequest(req)
+
+	if total := response.Header().Get("X-Total-Count"); total != "3" {
+		t.Errorf("Expected the owner to count 3 subscriptions. Got %s", total)
 	}
 }
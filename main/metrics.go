@@ -0,0 +1,124 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// metrics holds the Prometheus collectors of the app, served at /metrics
+type metrics struct {
+	registry *prometheus.Registry
+
+	requests       *prometheus.CounterVec
+	requestLatency *prometheus.HistogramVec
+	priceFetches   *prometheus.HistogramVec
+	priceErrors    *prometheus.CounterVec
+	alerts         *prometheus.CounterVec
+	notifications  *prometheus.CounterVec
+}
+
+func newMetrics(db *sql.DB) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "HTTP requests by route template, method and status code.",
+		}, []string{"route", "method", "code"}),
+		requestLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "HTTP request latency by route template and method.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		priceFetches: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "price_fetch_duration_seconds",
+			Help:    "Latency of fetching prices by source.",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"source"}),
+		priceErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "price_fetch_errors_total",
+			Help: "Failed price fetches by source.",
+		}, []string{"source"}),
+		alerts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "alerts_fired_total",
+			Help: "Alerts recorded by rule.",
+		}, []string{"rule"}),
+		notifications: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "notifications_total",
+			Help: "Notification attempts by channel and result (sent, failed or dead).",
+		}, []string{"channel", "result"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewDBStatsCollector(db, "crypto"),
+		m.requests, m.requestLatency, m.priceFetches, m.priceErrors, m.alerts, m.notifications,
+	)
+
+	return m
+}
+
+// handler serves the metrics in the Prometheus text format
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// instrument counts and times requests by the template of their mux route
+func (m *metrics) instrument(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &responseRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if tpl, err := current.GetPathTemplate(); err == nil {
+				route = tpl
+			}
+		}
+		status := rec.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		m.requests.WithLabelValues(route, r.Method, strconv.Itoa(status)).Inc()
+		m.requestLatency.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// observeFetch records a price fetch from source
+func (m *metrics) observeFetch(source string, took time.Duration, err error) {
+	if m == nil {
+		return
+	}
+	m.priceFetches.WithLabelValues(source).Observe(took.Seconds())
+	if err != nil {
+		m.priceErrors.WithLabelValues(source).Inc()
+	}
+}
+
+// alertFired counts a recorded alert
+func (m *metrics) alertFired(rule string) {
+	if m == nil {
+		return
+	}
+	m.alerts.WithLabelValues(rule).Inc()
+}
+
+// notified counts a notification attempt on channel
+func (m *metrics) notified(channel, result string) {
+	if m == nil {
+		return
+	}
+	m.notifications.WithLabelValues(channel, result).Inc()
+}
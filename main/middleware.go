@@ -1,24 +1,22 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
-	"time"
 
 	jwt "github.com/dgrijalva/jwt-go"
 )
 
-// LoggingHandler function to log request info
-func loggingHandler(next http.Handler) http.Handler {
-	fn := func(w http.ResponseWriter, r *http.Request) {
-		t1 := time.Now()
-		next.ServeHTTP(w, r)
-		t2 := time.Now()
-		log.Printf("[%s] %q %v\n", r.Method, r.URL.String(), t2.Sub(t1))
-	}
+type contextKey string
 
-	return http.HandlerFunc(fn)
+// userEmailKey holds the email of the authenticated user in the request context
+const userEmailKey contextKey = "userEmail"
+
+// userEmail returns the email of the user the request was authenticated as
+func userEmail(r *http.Request) string {
+	email, _ := r.Context().Value(userEmailKey).(string)
+	return email
 }
 
 // ValidateToken middleware for validating token
@@ -32,25 +30,65 @@ func validateToken(next http.Handler) http.Handler {
 			http.Error(w, "Please include a Token in authorization header", 400)
 			return
 		}
-		// validate the jwt
-		myToken, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-				return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
-			}
-			return []byte("mysecret"), nil
-		})
 
+		email, err := parseToken(tokenStr)
 		if err != nil {
 			http.Error(w, "Invalid Token", 401)
 			return
 		}
 
-		if _, ok := myToken.Claims.(jwt.MapClaims); ok && myToken.Valid {
-			next.ServeHTTP(w, r)
-		} else {
-			fmt.Println(err)
-		}
+		next.ServeHTTP(w, setRequestUser(r, email))
 	}
 
 	return http.HandlerFunc(fn)
 }
+
+// authenticateStream validates the token of a streaming request, which
+// browsers can only pass as a ?token= query parameter. It replies with an
+// error and returns false if the request is not authenticated.
+func authenticateStream(w http.ResponseWriter, r *http.Request) (string, bool) {
+	tokenStr := r.Header.Get("authorization")
+	if tokenStr == "" {
+		tokenStr = r.FormValue("token")
+	}
+	if tokenStr == "" {
+		http.Error(w, "Please include a Token in authorization header", 400)
+		return "", false
+	}
+
+	email, err := parseToken(tokenStr)
+	if err != nil {
+		http.Error(w, "Invalid Token", 401)
+		return "", false
+	}
+
+	noteRequestUser(r, email)
+	return email, true
+}
+
+// parseToken validates a jwt and returns the email of the user it was issued to
+func parseToken(tokenStr string) (string, error) {
+	myToken, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte("mysecret"), nil
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	claims, ok := myToken.Claims.(jwt.MapClaims)
+	if !ok || !myToken.Valid {
+		return "", errors.New("Invalid Token")
+	}
+
+	// every query of the caller is scoped to this email, so a token without
+	// one must not authenticate anybody
+	email, _ := claims["sub"].(string)
+	if email == "" {
+		return "", errors.New("Invalid Token")
+	}
+	return email, nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// notifier delivers an alert message to a phone number
+type notifier interface {
+	Channel() string
+	Notify(to, message string) error
+}
+
+// nexmoSMS sends text messages through the Nexmo SMS API
+type nexmoSMS struct {
+	APIKey string
+	Secret string
+	From   string
+	Client *http.Client
+}
+
+func newNexmoSMS(cfg config) *nexmoSMS {
+	return &nexmoSMS{
+		APIKey: cfg.NexmoAPIKey,
+		Secret: cfg.NexmoSecret,
+		From:   cfg.NexmoFrom,
+		Client: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (n *nexmoSMS) Channel() string {
+	return "sms"
+}
+
+func (n *nexmoSMS) Notify(to, message string) error {
+	resp, err := n.Client.PostForm("https://rest.nexmo.com/sms/json", url.Values{
+		"api_key":    {n.APIKey},
+		"api_secret": {n.Secret},
+		"from":       {n.From},
+		"to":         {to},
+		"text":       {message},
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var body struct {
+		Messages []struct {
+			Status    string `json:"status"`
+			ErrorText string `json:"error-text"`
+		} `json:"messages"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("nexmo: %v", err)
+	}
+
+	for _, m := range body.Messages {
+		if m.Status != "0" {
+			return errors.New("nexmo: " + m.ErrorText)
+		}
+	}
+
+	return nil
+}
+
+// logNotifier prints messages instead of sending them, used when no SMS
+// provider is configured
+type logNotifier struct{}
+
+func (logNotifier) Channel() string {
+	return "log"
+}
+
+func (logNotifier) Notify(to, message string) error {
+	slog.Info("notification", "component", "notifier", "to", to, "message", message)
+	return nil
+}
+
+// newNotifier picks the SMS notifier when Nexmo credentials are configured
+func newNotifier(cfg config) notifier {
+	if cfg.NexmoAPIKey == "" || cfg.NexmoSecret == "" {
+		return logNotifier{}
+	}
+	return newNexmoSMS(cfg)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// states of an outbox delivery
+const (
+	outboxPending = "pending"
+	outboxSent    = "sent"
+	outboxDead    = "dead"
+)
+
+// delivery is a notification waiting in the outbox. It is written in the
+// same transaction as the alert events it reports, so no alert is lost or
+// sent twice when the process stops in between.
+type delivery struct {
+	ID            int64     `json:"id"`
+	EventIDs      []int64   `json:"eventIds"`
+	Owner         string    `json:"owner"`
+	Channel       string    `json:"channel"`
+	Recipient     string    `json:"recipient"`
+	Message       string    `json:"message"`
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"lastError,omitempty"`
+	NextAttemptAt time.Time `json:"nextAttemptAt"`
+	CreatedAt     time.Time `json:"createdAt"`
+}
+
+const deliveryColumns = "id, event_ids, owner, channel, recipient, message, status, attempts, last_error, next_attempt_at, created_at"
+
+func scanDelivery(row scanner, d *delivery) error {
+	return row.Scan(&d.ID, pq.Array(&d.EventIDs), &d.Owner, &d.Channel, &d.Recipient, &d.Message,
+		&d.Status, &d.Attempts, &d.LastError, &d.NextAttemptAt, &d.CreatedAt)
+}
+
+// errNotDead is returned when requeueing a delivery that has not failed
+var errNotDead = errors.New("delivery has not failed")
+
+// enqueue adds the delivery to the outbox
+func (d *delivery) enqueue(db dbtx) error {
+	d.Status = outboxPending
+
+	return db.QueryRow(
+		`INSERT INTO outbox(event_ids, owner, channel, recipient, message, status)
+		VALUES($1, $2, $3, $4, $5, $6) RETURNING id, next_attempt_at, created_at`,
+		pq.Array(d.EventIDs), d.Owner, d.Channel, d.Recipient, d.Message, d.Status).Scan(&d.ID, &d.NextAttemptAt, &d.CreatedAt)
+}
+
+// claimDelivery locks the oldest delivery that is due. Rows locked by other
+// workers are skipped, so every delivery is claimed by one worker at a time
+// until tx ends. It returns sql.ErrNoRows when nothing is due.
+func claimDelivery(tx dbtx) (*delivery, error) {
+	var d delivery
+	err := scanDelivery(tx.QueryRow(
+		"SELECT "+deliveryColumns+` FROM outbox WHERE status=$1 AND next_attempt_at<=now()
+		ORDER BY next_attempt_at, id LIMIT 1 FOR UPDATE SKIP LOCKED`, outboxPending), &d)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &d, nil
+}
+
+// complete marks the delivery and its events as sent
+func (d *delivery) complete(db dbtx) error {
+	d.Attempts++
+	d.Status = outboxSent
+	d.LastError = ""
+
+	if _, err := db.Exec("UPDATE outbox SET status=$1, attempts=$2, last_error='' WHERE id=$3",
+		d.Status, d.Attempts, d.ID); err != nil {
+		return err
+	}
+
+	_, err := db.Exec("UPDATE alert_events SET status=$1, error='', delivered_at=now() WHERE id=ANY($2)",
+		deliverySent, pq.Array(d.EventIDs))
+
+	return err
+}
+
+// fail records a failed attempt. The delivery is retried after backoff, or
+// dead-lettered together with its events once maxAttempts is reached.
+func (d *delivery) fail(db dbtx, cause error, maxAttempts int) error {
+	d.Attempts++
+	d.LastError = cause.Error()
+	if d.Attempts >= maxAttempts {
+		d.Status = outboxDead
+	} else {
+		d.NextAttemptAt = time.Now().Add(retryBackoff(d.Attempts))
+	}
+
+	if _, err := db.Exec("UPDATE outbox SET status=$1, attempts=$2, last_error=$3, next_attempt_at=$4 WHERE id=$5",
+		d.Status, d.Attempts, d.LastError, d.NextAttemptAt, d.ID); err != nil {
+		return err
+	}
+
+	if d.Status != outboxDead {
+		return nil
+	}
+
+	_, err := db.Exec("UPDATE alert_events SET status=$1, error=$2 WHERE id=ANY($3)",
+		deliveryFailed, d.LastError, pq.Array(d.EventIDs))
+
+	return err
+}
+
+// retryBackoff is the wait before the next attempt after the given number
+// of failed ones: 30s, doubling up to an hour
+func retryBackoff(attempts int) time.Duration {
+	wait := 30 * time.Second
+	for i := 1; i < attempts && wait < time.Hour; i++ {
+		wait *= 2
+	}
+	if wait > time.Hour {
+		wait = time.Hour
+	}
+	return wait
+}
+
+func (d *delivery) getDelivery(db dbtx) error {
+	return scanDelivery(db.QueryRow("SELECT "+deliveryColumns+" FROM outbox WHERE id=$1", d.ID), d)
+}
+
+// requeue resets a dead delivery so the workers pick it up again
+func (d *delivery) requeue(db database) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = scanDelivery(tx.QueryRow(
+		"UPDATE outbox SET status=$1, attempts=0, next_attempt_at=now() WHERE id=$2 AND status=$3 RETURNING "+deliveryColumns,
+		outboxPending, d.ID, outboxDead), d)
+
+	if err == sql.ErrNoRows {
+		if err := d.getDelivery(db); err != nil {
+			return err
+		}
+		return errNotDead
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("UPDATE alert_events SET status=$1, error='' WHERE id=ANY($2)",
+		deliveryPending, pq.Array(d.EventIDs)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// deliveryQuery selects a page of the outbox, newest first
+type deliveryQuery struct {
+	Status string
+	Before int64
+	Count  int
+}
+
+// listDeliveries returns a page of deliveries matching q and the cursor of
+// the next page ("" on the last page).
+func listDeliveries(db dbtx, q deliveryQuery) ([]delivery, string, error) {
+	conds := []string{"TRUE"}
+	args := []interface{}{}
+
+	if q.Status != "" {
+		args = append(args, q.Status)
+		conds = append(conds, fmt.Sprintf("status=$%d", len(args)))
+	}
+	if q.Before != 0 {
+		args = append(args, q.Before)
+		conds = append(conds, fmt.Sprintf("id<$%d", len(args)))
+	}
+
+	args = append(args, q.Count+1)
+	rows, err := db.Query(
+		fmt.Sprintf("SELECT %s FROM outbox WHERE %s ORDER BY id DESC LIMIT $%d", deliveryColumns, strings.Join(conds, " AND "), len(args)),
+		args...)
+
+	if err != nil {
+		return nil, "", err
+	}
+
+	defer rows.Close()
+
+	deliveries := []delivery{}
+
+	for rows.Next() {
+		var d delivery
+		if err := scanDelivery(rows, &d); err != nil {
+			return nil, "", err
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(deliveries) <= q.Count {
+		return deliveries, "", nil
+	}
+
+	deliveries = deliveries[:q.Count]
+	return deliveries, strconv.FormatInt(deliveries[len(deliveries)-1].ID, 10), nil
+}
+
+// pruneDeliveries deletes sent deliveries older than age
+func pruneDeliveries(db dbtx, age time.Duration) error {
+	_, err := db.Exec("DELETE FROM outbox WHERE status=$1 AND created_at<$2", outboxSent, time.Now().Add(-age))
+
+	return err
+}
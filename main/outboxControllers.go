@@ -0,0 +1,98 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// adminOnly rejects requests from users that are not listed in a.Admins
+func (a *App) adminOnly(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		email := userEmail(r)
+		for _, admin := range a.Admins {
+			if email != "" && email == admin {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+
+		respondWithError(w, http.StatusForbidden, "Admin access required")
+	}
+
+	return http.HandlerFunc(fn)
+}
+
+// GET the outbox, newest first, optionally filtered by ?status=pending|sent|dead
+func (a *App) getDeliveries(w http.ResponseWriter, r *http.Request) {
+	q := deliveryQuery{Status: r.FormValue("status"), Count: 20}
+	switch q.Status {
+	case "", outboxPending, outboxSent, outboxDead:
+	default:
+		respondWithError(w, http.StatusBadRequest, "Invalid status")
+		return
+	}
+
+	if v := r.FormValue("count"); v != "" {
+		count, err := strconv.Atoi(v)
+		if err != nil || count < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid count")
+			return
+		}
+		if count > 100 {
+			count = 100
+		}
+		q.Count = count
+	}
+
+	if v := r.FormValue("cursor"); v != "" {
+		before, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || before < 1 {
+			respondWithError(w, http.StatusBadRequest, "Invalid cursor")
+			return
+		}
+		q.Before = before
+	}
+
+	deliveries, next, err := listDeliveries(a.store(r), q)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if next != "" {
+		values := r.URL.Query()
+		values.Set("cursor", next)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, values.Encode()))
+	}
+
+	respondWithJSON(w, http.StatusOK, deliveries)
+}
+
+// POST to retry a dead-lettered delivery
+func (a *App) requeueDelivery(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.ParseInt(vars["id"], 10, 64)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, "Invalid delivery ID")
+		return
+	}
+
+	d := delivery{ID: id}
+	if err := d.requeue(a.store(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Delivery not found")
+		case errNotDead:
+			respondWithError(w, http.StatusConflict, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, d)
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// pivotQuotes are fetched alongside the requested quotes so that pairs the
+// price source does not list directly can be derived through them.
+var pivotQuotes = []string{"USD", "BTC", "ETH"}
+
+// priceSource fetches current prices for token/quote pairs.
+type priceSource interface {
+	Name() string
+	Prices(ctx context.Context, tokens, quotes []string) (quoteBook, error)
+}
+
+// ticker is the latest quote of a pair
+type ticker struct {
+	Price  float64
+	Volume float64
+}
+
+// quoteBook maps token -> quote -> ticker as returned by a price source.
+type quoteBook map[string]map[string]ticker
+
+func (b quoteBook) direct(token, quote string) (float64, bool) {
+	if token == quote {
+		return 1, true
+	}
+	if t, ok := b[token][quote]; ok && t.Price > 0 {
+		return t.Price, true
+	}
+	if inv, ok := b[quote][token]; ok && inv.Price > 0 {
+		return 1 / inv.Price, true
+	}
+	return 0, false
+}
+
+// rate returns the price of token in quote, deriving a cross rate through a
+// pivot currency when the pair was not quoted directly.
+func (b quoteBook) rate(token, quote string) (float64, bool) {
+	if p, ok := b.direct(token, quote); ok {
+		return p, true
+	}
+
+	for _, pivot := range pivotQuotes {
+		viaPivot, ok := b.direct(token, pivot)
+		if !ok {
+			continue
+		}
+		if pivotInQuote, ok := b.direct(pivot, quote); ok {
+			return viaPivot * pivotInQuote, true
+		}
+	}
+
+	return 0, false
+}
+
+// pricePair formats a token and quote the way they appear in messages
+func pricePair(token, quote string) string {
+	return token + "/" + quote
+}
+
+// formatPrice renders a price with enough precision for its quote currency
+func formatPrice(price float64, quote string) string {
+	switch quote {
+	case "USD", "EUR", "GBP", "JPY":
+		return fmt.Sprintf("%.2f %s", price, quote)
+	default:
+		return fmt.Sprintf("%.8f %s", price, quote)
+	}
+}
+
+// cryptoCompare reads prices from the public CryptoCompare API
+type cryptoCompare struct {
+	BaseURL string
+	Client  *http.Client
+}
+
+func newCryptoCompare() *cryptoCompare {
+	return &cryptoCompare{
+		BaseURL: "https://min-api.cryptocompare.com",
+		Client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (c *cryptoCompare) Name() string {
+	return "cryptocompare"
+}
+
+func (c *cryptoCompare) Prices(ctx context.Context, tokens, quotes []string) (quoteBook, error) {
+	if len(tokens) == 0 {
+		return quoteBook{}, nil
+	}
+
+	q := url.Values{}
+	q.Set("fsyms", strings.Join(tokens, ","))
+	q.Set("tsyms", strings.Join(quotes, ","))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/data/pricemultifull?"+q.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("cryptocompare: unexpected status %s", resp.Status)
+	}
+
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+
+	// errors come back with a 200 status and a Response field
+	if _, ok := body["Response"]; ok {
+		var message string
+		json.Unmarshal(body["Message"], &message)
+		return nil, errors.New("cryptocompare: " + message)
+	}
+
+	var raw map[string]map[string]struct {
+		Price        float64 `json:"PRICE"`
+		Volume24Hour float64 `json:"VOLUME24HOUR"`
+	}
+	if err := json.Unmarshal(body["RAW"], &raw); err != nil {
+		return nil, fmt.Errorf("cryptocompare: %v", err)
+	}
+
+	book := quoteBook{}
+	for token, quotes := range raw {
+		book[token] = map[string]ticker{}
+		for quote, t := range quotes {
+			book[token][quote] = ticker{Price: t.Price, Volume: t.Volume24Hour}
+		}
+	}
+
+	return book, nil
+}
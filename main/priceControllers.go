@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// candleIntervals are the candle widths accepted by GET /prices/{token}
+var candleIntervals = map[string]time.Duration{
+	"1m":  time.Minute,
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+	"1h":  time.Hour,
+	"4h":  4 * time.Hour,
+	"1d":  24 * time.Hour,
+	"1w":  7 * 24 * time.Hour,
+}
+
+// maxCandles bounds the number of candles a single request can ask for
+const maxCandles = 1000
+
+// GET OHLC candles for a token, ?quote=USD&interval=1h&from=...&to=... with
+// RFC 3339 times; defaults to the last 24 hours in hourly candles
+func (a *App) getPrices(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	token := normalizeToken(vars["token"])
+
+	quote := normalizeToken(r.FormValue("quote"))
+	if quote == "" {
+		quote = defaultQuote
+	}
+
+	name := r.FormValue("interval")
+	if name == "" {
+		name = "1h"
+	}
+	interval, ok := candleIntervals[name]
+	if !ok {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Invalid interval %q", name))
+		return
+	}
+
+	to := time.Now().UTC()
+	if v := r.FormValue("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid to time")
+			return
+		}
+		to = t
+	}
+
+	from := to.Add(-24 * time.Hour)
+	if v := r.FormValue("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid from time")
+			return
+		}
+		from = t
+	}
+
+	if !from.Before(to) {
+		respondWithError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+	if to.Sub(from)/interval > maxCandles {
+		respondWithError(w, http.StatusBadRequest, fmt.Sprintf("Range covers more than %d candles", maxCandles))
+		return
+	}
+
+	candles, err := getCandles(a.store(r), token, quote, from, to, interval)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, candles)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// rollupResolution is the width in seconds of the rows raw samples are
+// downsampled into once they are older than the raw retention.
+const rollupResolution = 3600
+
+// pricePoint is one row of the prices time series
+type pricePoint struct {
+	Token  string
+	Quote  string
+	Price  float64
+	Volume float64
+	Source string
+	Time   time.Time
+}
+
+type candle struct {
+	Time    time.Time `json:"time"`
+	Open    float64   `json:"open"`
+	High    float64   `json:"high"`
+	Low     float64   `json:"low"`
+	Close   float64   `json:"close"`
+	Volume  float64   `json:"volume"`
+	Samples int       `json:"samples"`
+}
+
+// insertPrices stores a polling round of samples in one statement
+func insertPrices(db dbtx, points []pricePoint) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	rows := make([]string, len(points))
+	args := make([]interface{}, 0, 6*len(points))
+	for i, p := range points {
+		n := len(args)
+		rows[i] = fmt.Sprintf("($%d, $%d, $%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4, n+5, n+6)
+		args = append(args, p.Token, p.Quote, p.Price, p.Volume, p.Source, p.Time)
+	}
+
+	_, err := db.Exec("INSERT INTO prices(token, quote, price, volume, source, ts) VALUES "+strings.Join(rows, ", "), args...)
+
+	return err
+}
+
+// prunePrices downsamples raw samples older than rawRetention into hourly
+// rows keeping the last price and volume of each hour, and deletes anything
+// older than maxRetention.
+func prunePrices(db database, rawRetention, maxRetention time.Duration) error {
+	now := time.Now()
+	rawCutoff := now.Add(-rawRetention)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO prices(token, quote, price, volume, source, resolution, ts)
+		SELECT token, quote, (array_agg(price ORDER BY ts DESC))[1], (array_agg(volume ORDER BY ts DESC))[1], source, $2, date_trunc('hour', ts)
+		FROM prices WHERE resolution=0 AND ts < date_trunc('hour', $1::timestamptz)
+		GROUP BY token, quote, source, date_trunc('hour', ts)`,
+		rawCutoff, rollupResolution)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM prices WHERE resolution=0 AND ts < date_trunc('hour', $1::timestamptz)", rawCutoff); err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec("DELETE FROM prices WHERE ts < $1", now.Add(-maxRetention)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// lookbackWindows are the rolling windows percent changes can be measured
+// over
+var lookbackWindows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+}
+
+// errNoHistory is returned when no stored price is close enough to the time
+// asked for
+var errNoHistory = errors.New("not enough price history")
+
+// priceAt returns the stored price of a pair closest to at, looking no
+// further than tolerance either side. Gaps in the history (the poller was
+// down, or the pair was not watched yet) give errNoHistory rather than a
+// price from the wrong time.
+func priceAt(db dbtx, token, quote string, at time.Time, tolerance time.Duration) (float64, error) {
+	var price float64
+	err := db.QueryRow(
+		`SELECT price FROM prices WHERE token=$1 AND quote=$2 AND ts BETWEEN $3 AND $4
+		ORDER BY abs(extract(epoch FROM ts - $5::timestamptz)) LIMIT 1`,
+		token, quote, at.Add(-tolerance), at.Add(tolerance), at).Scan(&price)
+
+	if err == sql.ErrNoRows {
+		return 0, errNoHistory
+	}
+
+	return price, err
+}
+
+// historyTolerance is how far from the start of a lookback window a stored
+// price may be and still count as the price at that time
+func historyTolerance(window time.Duration) time.Duration {
+	tolerance := window / 10
+	if tolerance < 10*time.Minute {
+		tolerance = 10 * time.Minute
+	}
+	return tolerance
+}
+
+// getCandles aggregates the stored prices of a pair into OHLC candles of
+// interval width covering [from, to).
+func getCandles(db dbtx, token, quote string, from, to time.Time, interval time.Duration) ([]candle, error) {
+	rows, err := db.Query(
+		`SELECT to_timestamp(floor(extract(epoch FROM ts) / $5) * $5) AS bucket,
+			(array_agg(price ORDER BY ts))[1], MAX(price), MIN(price), (array_agg(price ORDER BY ts DESC))[1],
+			(array_agg(volume ORDER BY ts DESC))[1], COUNT(*)
+		FROM prices WHERE token=$1 AND quote=$2 AND ts >= $3 AND ts < $4
+		GROUP BY bucket ORDER BY bucket`,
+		token, quote, from, to, int64(interval/time.Second))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	candles := []candle{}
+
+	for rows.Next() {
+		var c candle
+		if err := rows.Scan(&c.Time, &c.Open, &c.High, &c.Low, &c.Close, &c.Volume, &c.Samples); err != nil {
+			return nil, err
+		}
+		c.Time = c.Time.UTC()
+		candles = append(candles, c)
+	}
+
+	return candles, rows.Err()
+}
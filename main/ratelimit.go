@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/justinas/alice"
+)
+
+// rate limit groups of initializeRoutes
+const (
+	limitAuth   = "auth"   // register and login, by client IP
+	limitAPI    = "api"    // authenticated routes, by user
+	limitStream = "stream" // live streams, by client IP
+)
+
+// RateLimit allows Requests requests per Per to each client, in bursts of up
+// to Requests. It is written as "requests/period" in JSON, e.g. "10/1m"; an
+// empty string disables the limit.
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func parseRateLimit(s string) (RateLimit, error) {
+	if s == "" {
+		return RateLimit{}, nil
+	}
+
+	n, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return RateLimit{}, fmt.Errorf("rate limit %q: want requests/period, e.g. 10/1m", s)
+	}
+	requests, err := strconv.Atoi(n)
+	if err != nil || requests < 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q: invalid number of requests", s)
+	}
+	period, err := time.ParseDuration(per)
+	if err != nil || period <= 0 {
+		return RateLimit{}, fmt.Errorf("rate limit %q: invalid period", s)
+	}
+
+	return RateLimit{Requests: requests, Per: period}, nil
+}
+
+func (l *RateLimit) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	v, err := parseRateLimit(s)
+	if err != nil {
+		return err
+	}
+
+	*l = v
+	return nil
+}
+
+func (l RateLimit) MarshalJSON() ([]byte, error) {
+	if l.disabled() {
+		return json.Marshal("")
+	}
+	return json.Marshal(fmt.Sprintf("%d/%s", l.Requests, l.Per))
+}
+
+func (l RateLimit) disabled() bool {
+	return l.Requests <= 0 || l.Per <= 0
+}
+
+// refillRate is the number of requests regained per second
+func (l RateLimit) refillRate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+// bucket holds the requests left to a client
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// limiterSweep is how often buckets that have refilled are dropped
+const limiterSweep = time.Minute
+
+// rateLimiter keeps a token bucket per client of one route group
+type rateLimiter struct {
+	mu        sync.Mutex
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{buckets: map[string]*bucket{}, lastSweep: time.Now()}
+}
+
+// take spends a request of key. It returns whether the request is allowed,
+// the requests left and how long until the next one is available.
+func (rl *rateLimiter) take(key string, limit RateLimit, now time.Time) (bool, int, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	capacity := float64(limit.Requests)
+	rate := limit.refillRate()
+
+	if now.Sub(rl.lastSweep) >= limiterSweep {
+		for k, b := range rl.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rate >= capacity {
+				delete(rl.buckets, k)
+			}
+		}
+		rl.lastSweep = now
+	}
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, 0, wait
+	}
+
+	b.tokens--
+	return true, int(b.tokens), 0
+}
+
+// reset returns how long until the bucket of key is full again
+func (rl *rateLimiter) reset(key string, limit RateLimit) time.Duration {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		return 0
+	}
+	return time.Duration((float64(limit.Requests) - b.tokens) / limit.refillRate() * float64(time.Second))
+}
+
+// rateLimit returns a middleware limiting the requests of group as
+// configured in a.RateLimits. Requests are counted per authenticated user
+// when byUser is set and per client IP otherwise.
+func (a *App) rateLimit(group string, byUser bool) alice.Constructor {
+	rl := newRateLimiter()
+
+	return func(next http.Handler) http.Handler {
+		fn := func(w http.ResponseWriter, r *http.Request) {
+			limit := a.RateLimits[group]
+			if limit.disabled() {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			key := "ip:" + clientIP(r)
+			if email := userEmail(r); byUser && email != "" {
+				key = "user:" + email
+			}
+
+			allowed, remaining, wait := rl.take(key, limit, time.Now())
+			w.Header().Set("X-RateLimit-Limit", strconv.Itoa(limit.Requests))
+			w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+			w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(rl.reset(key, limit))))
+
+			if !allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(ceilSeconds(wait)))
+				respondWithError(w, http.StatusTooManyRequests, "Rate limit exceeded")
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		}
+
+		return http.HandlerFunc(fn)
+	}
+}
+
+// clientIP returns the IP address the request came from
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func ceilSeconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
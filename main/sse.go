@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	// comment lines are sent with this period to keep proxies from closing
+	// idle streams
+	sseHeartbeat = 15 * time.Second
+
+	// delay browsers wait before reconnecting, in milliseconds
+	sseRetry = 5000
+
+	// most events replayed to a client resuming from Last-Event-ID
+	sseReplayLimit = 1000
+
+	// feed entries queued for a client before it is considered too slow
+	sseSendQueue = 64
+)
+
+// GET /events/stream streams the caller's alert firings and subscription
+// changes as Server-Sent Events. Clients resume with the Last-Event-ID
+// header (or ?lastEventId=) and receive the entries they missed first. When
+// more than sseReplayLimit were missed a "truncated" event follows the
+// replayed ones and the stream ends, so the client resumes from there.
+func (a *App) streamEvents(w http.ResponseWriter, r *http.Request) {
+	email, ok := authenticateStream(w, r)
+	if !ok {
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, http.StatusInternalServerError, "Streaming unsupported")
+		return
+	}
+
+	lastID := r.Header.Get("Last-Event-ID")
+	if lastID == "" {
+		lastID = r.FormValue("lastEventId")
+	}
+	var after int64
+	if lastID != "" {
+		id, err := strconv.ParseInt(lastID, 10, 64)
+		if err != nil || id < 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid Last-Event-ID")
+			return
+		}
+		after = id
+	}
+
+	// register before replaying so nothing published in between is lost;
+	// duplicates are skipped by id below. Entries of a user are pushed in
+	// id order, see publishUserEvent.
+	c := newHubClient(email, true, sseSendQueue)
+	a.hub.register(c)
+	defer a.hub.unregister(c)
+
+	var missed []userEvent
+	if lastID != "" {
+		var err error
+		missed, err = getUserEventsAfter(a.store(r), email, after, sseReplayLimit)
+		if err != nil {
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	// the stream outlives the server's write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", sseRetry)
+
+	for i := range missed {
+		e := &missed[i]
+		data, _ := json.Marshal(e)
+		writeSSE(w, e.ID, e.Type, data)
+		after = e.ID
+	}
+	if len(missed) == sseReplayLimit {
+		// more entries are waiting; tell the client and end the stream so
+		// it reconnects from the last replayed id for the next batch
+		fmt.Fprintf(w, "event: truncated\ndata: {\"lastEventId\":%d}\n\n", after)
+		flusher.Flush()
+		return
+	}
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(sseHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case f := <-c.send:
+			if f.id <= after {
+				continue
+			}
+			writeSSE(w, f.id, f.event, f.data)
+			after = f.id
+			flusher.Flush()
+		case <-heartbeat.C:
+			fmt.Fprint(w, ": ping\n\n")
+			flusher.Flush()
+		case <-c.done:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+// writeSSE writes a single event; data must not contain newlines, which
+// holds for encoded JSON
+func writeSSE(w http.ResponseWriter, id int64, event string, data []byte) {
+	fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", id, event, data)
+}
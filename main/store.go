@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.37.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// txn is a transaction started by a database
+type txn interface {
+	dbtx
+	Commit() error
+	Rollback() error
+}
+
+// database is a dbtx that can also start transactions
+type database interface {
+	dbtx
+	Begin() (txn, error)
+}
+
+// contextQueryer is satisfied by *sql.DB and *sql.Tx
+type contextQueryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// ctxQueryer runs queries with the context of a request, so they are
+// cancelled with the request, traced and logged with its logger.
+type ctxQueryer struct {
+	q   contextQueryer
+	ctx context.Context
+}
+
+// ctxDB is the database handle of a request
+type ctxDB struct {
+	ctxQueryer
+	db *sql.DB
+}
+
+// ctxTx is a transaction started by a ctxDB
+type ctxTx struct {
+	ctxQueryer
+	tx *sql.Tx
+}
+
+// store returns the database handle for the queries of r
+func (a *App) store(r *http.Request) database {
+	return withContext(r.Context(), a.DB)
+}
+
+// withContext returns a database handle running its queries with ctx
+func withContext(ctx context.Context, db *sql.DB) ctxDB {
+	return ctxDB{ctxQueryer: ctxQueryer{q: db, ctx: ctx}, db: db}
+}
+
+func (c ctxQueryer) Exec(query string, args ...interface{}) (sql.Result, error) {
+	ctx, done := startQuery(c.ctx, query)
+	res, err := c.q.ExecContext(ctx, query, args...)
+	done(err)
+
+	return res, err
+}
+
+func (c ctxQueryer) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	ctx, done := startQuery(c.ctx, query)
+	rows, err := c.q.QueryContext(ctx, query, args...)
+	done(err)
+
+	return rows, err
+}
+
+func (c ctxQueryer) QueryRow(query string, args ...interface{}) *sql.Row {
+	ctx, done := startQuery(c.ctx, query)
+	row := c.q.QueryRowContext(ctx, query, args...)
+	done(row.Err())
+
+	return row
+}
+
+func (c ctxDB) Begin() (txn, error) {
+	tx, err := c.db.BeginTx(c.ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return ctxTx{ctxQueryer: ctxQueryer{q: tx, ctx: c.ctx}, tx: tx}, nil
+}
+
+func (c ctxTx) Commit() error {
+	return c.tx.Commit()
+}
+
+func (c ctxTx) Rollback() error {
+	return c.tx.Rollback()
+}
+
+// startQuery opens the span of a query. The returned function ends it and
+// logs the query at debug level, or a failed one as a warning.
+func startQuery(ctx context.Context, query string) (context.Context, func(error)) {
+	query = strings.Join(strings.Fields(query), " ")
+	operation := query
+	if i := strings.IndexByte(query, ' '); i > 0 {
+		operation = query[:i]
+	}
+
+	ctx, span := tracer.Start(ctx, "db "+strings.ToUpper(operation),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemNamePostgreSQL, semconv.DBQueryText(query)))
+	start := time.Now()
+
+	return ctx, func(err error) {
+		defer span.End()
+		logger := loggerFrom(ctx)
+
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+			logger.Warn("query failed", "query", query, "duration", time.Since(start), "error", err)
+			return
+		}
+		logger.Debug("query", "query", query, "duration", time.Since(start))
+	}
+}
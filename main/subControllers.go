@@ -2,9 +2,13 @@ package main
 
 import (
 	"database/sql"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"net/http"
 	"strconv"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
@@ -18,8 +22,8 @@ func (a *App) getSub(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s := sub{ID: id}
-	if err := s.getSub(a.DB); err != nil {
+	s := sub{ID: id, Owner: userEmail(r)}
+	if err := s.getSub(a.store(r)); err != nil {
 		switch err {
 		case sql.ErrNoRows:
 			respondWithError(w, http.StatusNotFound, "Subscription not found")
@@ -32,47 +36,163 @@ func (a *App) getSub(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusOK, s)
 }
 
-// GET sub by token
+// GET the caller's subscriptions for one or more comma separated tokens
 func (a *App) getSubByToken(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
-	token := vars["token"]
 
-	s := sub{Token: token}
-	if err := s.getSubByToken(a.DB); err != nil {
-		switch err {
-		case sql.ErrNoRows:
-			respondWithError(w, http.StatusNotFound, "Subscription not found")
-		default:
-			respondWithError(w, http.StatusInternalServerError, err.Error())
+	tokens := []string{}
+	seen := map[string]bool{}
+	for _, t := range strings.Split(vars["token"], ",") {
+		t = normalizeToken(t)
+		if t == "" || seen[t] {
+			continue
 		}
+		seen[t] = true
+		tokens = append(tokens, t)
+	}
+
+	if len(tokens) == 0 {
+		respondWithError(w, http.StatusBadRequest, "Invalid token")
 		return
 	}
 
-	respondWithJSON(w, http.StatusOK, s)
+	subs, err := getSubsByTokens(a.store(r), userEmail(r), tokens)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, subs)
 }
 
 // GET all subscriptions
 func (a *App) getAllSubs(w http.ResponseWriter, r *http.Request) {
-	count, _ := strconv.Atoi(r.FormValue("count"))
-	start, _ := strconv.Atoi(r.FormValue("start"))
-
-	if count > 10 || count < 1 {
-		count = 10
+	q, err := parseSubQuery(r)
+	if err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
 	}
 
-	if start < 0 {
-		start = 0
+	total, err := countSubs(a.store(r), q)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
 
-	subs, err := getAllSubs(a.DB, start, count)
+	subs, next, err := listSubs(a.store(r), q)
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	w.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if next != "" {
+		values := r.URL.Query()
+		values.Set("cursor", next)
+		w.Header().Set("Link", fmt.Sprintf("<%s?%s>; rel=\"next\"", r.URL.Path, values.Encode()))
+	}
+
 	respondWithJSON(w, http.StatusOK, subs)
 }
 
+// parseSubQuery reads the pagination, filter and sort parameters of
+// GET /subscriptions.
+func parseSubQuery(r *http.Request) (subQuery, error) {
+	q := subQuery{Owner: userEmail(r), Count: 10}
+
+	if v := r.FormValue("count"); v != "" {
+		count, err := strconv.Atoi(v)
+		if err != nil || count < 1 {
+			return q, errors.New("Invalid count")
+		}
+		if count > 100 {
+			count = 100
+		}
+		q.Count = count
+	}
+
+	if v := r.FormValue("sort"); v != "" {
+		if strings.HasPrefix(v, "-") {
+			q.Desc = true
+			v = v[1:]
+		}
+		if _, ok := subSortColumns[v]; !ok {
+			return q, fmt.Errorf("Invalid sort field %q", v)
+		}
+		q.Sort = v
+	}
+
+	// a cursor is only valid for the sort it was issued for
+	if v := r.FormValue("cursor"); v != "" {
+		c, err := decodeSubCursor(v)
+		if err != nil || c.Sort != q.sortKey() {
+			return q, errors.New("Invalid cursor")
+		}
+		q.After = c
+	}
+
+	q.Token = normalizeToken(r.FormValue("token"))
+	q.Quote = normalizeToken(r.FormValue("quote"))
+
+	if v := r.FormValue("active"); v != "" {
+		active, err := strconv.ParseBool(v)
+		if err != nil {
+			return q, errors.New("Invalid active filter")
+		}
+		q.Active = &active
+	}
+
+	ranges := []struct {
+		name string
+		r    *subRange
+	}{
+		{"percent", &q.Percent},
+		{"minVal", &q.MinVal},
+		{"maxVal", &q.MaxVal},
+		{"minMaxChange", &q.MinMaxChange},
+	}
+	for _, f := range ranges {
+		for _, bound := range []string{"gte", "lte"} {
+			v := r.FormValue(f.name + "_" + bound)
+			if v == "" {
+				continue
+			}
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return q, fmt.Errorf("Invalid %s_%s filter", f.name, bound)
+			}
+			if bound == "gte" {
+				f.r.Gte = &n
+			} else {
+				f.r.Lte = &n
+			}
+		}
+	}
+
+	return q, nil
+}
+
+// checkSub validates s before it is created or updated, replying with an
+// error and returning false if it is invalid
+func (a *App) checkSub(w http.ResponseWriter, r *http.Request, s *sub) bool {
+	if err := s.validate(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return false
+	}
+
+	if err := s.checkAsset(a.store(r)); err != nil {
+		switch err.(type) {
+		case validationError:
+			respondWithError(w, http.StatusBadRequest, err.Error())
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return false
+	}
+
+	return true
+}
+
 func (a *App) createSub(w http.ResponseWriter, r *http.Request) {
 	var s sub
 	decoder := json.NewDecoder(r.Body)
@@ -81,12 +201,18 @@ func (a *App) createSub(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	s.Owner = userEmail(r)
+
+	if !a.checkSub(w, r, &s) {
+		return
+	}
 
-	if err := s.createSub(a.DB); err != nil {
+	if err := s.createSub(a.store(r)); err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
+	publishUserEvent(a.store(r), a.hub, s.Owner, feedSubCreated, s)
 	respondWithJSON(w, http.StatusCreated, s)
 }
 
@@ -106,12 +232,23 @@ func (a *App) updateSub(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 	s.ID = id
+	s.Owner = userEmail(r)
 
-	if err := s.updateSub(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	if !a.checkSub(w, r, &s) {
+		return
+	}
+
+	if err := s.updateSub(a.store(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Subscription not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
 
+	publishUserEvent(a.store(r), a.hub, s.Owner, feedSubUpdated, s)
 	respondWithJSON(w, http.StatusOK, s)
 }
 
@@ -123,11 +260,166 @@ func (a *App) deleteSub(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s := sub{ID: id}
-	if err := s.deleteSub(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	s := sub{ID: id, Owner: userEmail(r)}
+	if err := s.deleteSub(a.store(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "Subscription not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
 		return
 	}
 
+	publishUserEvent(a.store(r), a.hub, s.Owner, feedSubDeleted, s)
 	respondWithJSON(w, http.StatusOK, map[string]string{"result": "success"})
 }
+
+// importResult reports the outcome of a single imported row
+type importResult struct {
+	Row   int    `json:"row"`
+	ID    int    `json:"id,omitempty"`
+	Error string `json:"error,omitempty"`
+}
+
+// maxImportSize bounds the body of an import request
+const maxImportSize = 1 << 20
+
+// POST subscriptions in bulk from a JSON array or a CSV file with a header row.
+// All rows are created in one transaction; if any row is invalid nothing is
+// stored and the per-row results are returned with 422.
+func (a *App) importSubs(w http.ResponseWriter, r *http.Request) {
+	body := http.MaxBytesReader(w, r.Body, maxImportSize)
+	defer r.Body.Close()
+
+	var (
+		subs []sub
+		errs []string
+	)
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		reader := csv.NewReader(body)
+		reader.FieldsPerRecord = -1
+		records, err := reader.ReadAll()
+		if err != nil || len(records) == 0 {
+			respondWithError(w, http.StatusBadRequest, "Invalid CSV Payload")
+			return
+		}
+
+		columns := map[string]int{}
+		for i, name := range records[0] {
+			columns[strings.TrimSpace(name)] = i
+		}
+		if _, ok := columns["token"]; !ok {
+			respondWithError(w, http.StatusBadRequest, "CSV header must include a token column")
+			return
+		}
+
+		for _, record := range records[1:] {
+			s, err := subFromCSV(columns, record)
+			subs = append(subs, s)
+			errs = append(errs, errorString(err))
+		}
+	} else {
+		if err := json.NewDecoder(body).Decode(&subs); err != nil {
+			respondWithError(w, http.StatusBadRequest, "Invalid Request Payload")
+			return
+		}
+		errs = make([]string, len(subs))
+	}
+
+	if len(subs) == 0 {
+		respondWithError(w, http.StatusBadRequest, "No subscriptions to import")
+		return
+	}
+
+	owner := userEmail(r)
+	results := make([]importResult, len(subs))
+	failed := false
+	for i := range subs {
+		results[i].Row = i + 1
+		subs[i].ID = 0
+		subs[i].Owner = owner
+		if errs[i] == "" {
+			errs[i] = errorString(subs[i].validate())
+		}
+		if errs[i] == "" {
+			err := subs[i].checkAsset(a.store(r))
+			if _, ok := err.(validationError); err != nil && !ok {
+				respondWithError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			errs[i] = errorString(err)
+		}
+		if errs[i] != "" {
+			results[i].Error = errs[i]
+			failed = true
+		}
+	}
+
+	if failed {
+		respondWithJSON(w, http.StatusUnprocessableEntity, results)
+		return
+	}
+
+	tx, err := a.store(r).Begin()
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	defer tx.Rollback()
+
+	for i := range subs {
+		if err := subs[i].createSub(tx); err != nil {
+			respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("row %d: %v", i+1, err))
+			return
+		}
+		results[i].ID = subs[i].ID
+	}
+
+	if err := tx.Commit(); err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	for i := range subs {
+		publishUserEvent(a.store(r), a.hub, owner, feedSubCreated, subs[i])
+	}
+
+	respondWithJSON(w, http.StatusCreated, results)
+}
+
+// GET all of the caller's subscriptions as JSON (default) or CSV (?format=csv)
+func (a *App) exportSubs(w http.ResponseWriter, r *http.Request) {
+	format := r.FormValue("format")
+	if format == "" && strings.HasPrefix(r.Header.Get("Accept"), "text/csv") {
+		format = "csv"
+	}
+	if format != "" && format != "csv" && format != "json" {
+		respondWithError(w, http.StatusBadRequest, "Invalid export format")
+		return
+	}
+
+	subs, err := getSubsByOwner(a.store(r), userEmail(r))
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if format != "csv" {
+		w.Header().Set("Content-Disposition", `attachment; filename="subscriptions.json"`)
+		respondWithJSON(w, http.StatusOK, subs)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", `attachment; filename="subscriptions.csv"`)
+	w.WriteHeader(http.StatusOK)
+
+	writer := csv.NewWriter(w)
+	writer.Write(subCSVHeader)
+	for i := range subs {
+		writer.Write(subs[i].csvRecord())
+	}
+	writer.Flush()
+}
@@ -2,47 +2,261 @@ package main
 
 import (
 	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
 )
 
 type sub struct {
 	ID           int     `json:"id"`
 	Token        string  `json:"token"`
+	Quote        string  `json:"quote"`
 	Percent      float64 `json:"percent"`
+	Window       string  `json:"window,omitempty"`
 	MinVal       float64 `json:"minVal"`
 	MaxVal       float64 `json:"maxVal"`
 	MinMaxChange float64 `json:"minMaxChange"`
+	Condition    string  `json:"condition,omitempty"`
+	Cooldown     int     `json:"cooldown,omitempty"`
 	Active       bool    `json:"active"`
+	Owner        string  `json:"-"`
+}
+
+// subColumns is the column list read by scanSub
+const subColumns = "id, token, quote, percent, lookback, minval, maxval, minmaxchange, condition, cooldown, COALESCE(active, FALSE), owner"
+
+// scanner is implemented by *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanSub(row scanner, s *sub) error {
+	return row.Scan(&s.ID, &s.Token, &s.Quote, &s.Percent, &s.Window, &s.MinVal, &s.MaxVal, &s.MinMaxChange, &s.Condition, &s.Cooldown, &s.Active, &s.Owner)
+}
+
+// defaultQuote is used for subscriptions created without a quote currency
+const defaultQuote = "USD"
+
+// dbtx is satisfied by both *sql.DB and *sql.Tx so model methods can run
+// inside a transaction.
+type dbtx interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// subCSVHeader lists the columns used when importing and exporting
+// subscriptions as CSV.
+var subCSVHeader = []string{"id", "token", "quote", "percent", "window", "minVal", "maxVal", "minMaxChange", "condition", "cooldown", "active"}
+
+// validate checks the fields of a subscription before it is stored.
+func (s *sub) validate() error {
+	token := normalizeToken(s.Token)
+	if token == "" {
+		return errors.New("token is required")
+	}
+	for _, c := range token {
+		if c < 'A' || c > 'Z' {
+			return fmt.Errorf("invalid token %q", s.Token)
+		}
+	}
+	for _, c := range normalizeToken(s.Quote) {
+		if c < 'A' || c > 'Z' {
+			return fmt.Errorf("invalid quote %q", s.Quote)
+		}
+	}
+	if s.Percent < 0 || s.MinVal < 0 || s.MaxVal < 0 || s.MinMaxChange < 0 {
+		return errors.New("percent, minVal, maxVal and minMaxChange must not be negative")
+	}
+	if s.Cooldown < 0 {
+		return errors.New("cooldown must not be negative")
+	}
+	if s.MinVal > 0 && s.MaxVal > 0 && s.MinVal > s.MaxVal {
+		return errors.New("minVal must not be greater than maxVal")
+	}
+	if w := strings.TrimSpace(s.Window); w != "" {
+		if _, ok := lookbackWindows[strings.ToLower(w)]; !ok {
+			return fmt.Errorf("invalid window %q, use 1h, 24h or 7d", s.Window)
+		}
+		if s.Percent == 0 {
+			return errors.New("window needs a percent to compare the change with")
+		}
+	}
+	if strings.TrimSpace(s.Condition) != "" {
+		if _, err := parseCondition(s.Condition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// csvRecord returns the subscription as a row matching subCSVHeader.
+func (s *sub) csvRecord() []string {
+	return []string{
+		strconv.Itoa(s.ID),
+		s.Token,
+		s.Quote,
+		strconv.FormatFloat(s.Percent, 'f', -1, 64),
+		s.Window,
+		strconv.FormatFloat(s.MinVal, 'f', -1, 64),
+		strconv.FormatFloat(s.MaxVal, 'f', -1, 64),
+		strconv.FormatFloat(s.MinMaxChange, 'f', -1, 64),
+		s.Condition,
+		strconv.Itoa(s.Cooldown),
+		strconv.FormatBool(s.Active),
+	}
+}
+
+// subFromCSV reads a subscription from a CSV record. columns maps the
+// header names to their index; missing columns keep their zero value and
+// the id column is ignored.
+func subFromCSV(columns map[string]int, record []string) (sub, error) {
+	var s sub
+	field := func(name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	s.Token = field("token")
+	s.Quote = field("quote")
+	s.Condition = field("condition")
+	s.Window = field("window")
+
+	numbers := []struct {
+		name string
+		dst  *float64
+	}{
+		{"percent", &s.Percent},
+		{"minVal", &s.MinVal},
+		{"maxVal", &s.MaxVal},
+		{"minMaxChange", &s.MinMaxChange},
+	}
+	for _, n := range numbers {
+		v := field(n.name)
+		if v == "" {
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return s, fmt.Errorf("invalid %s %q", n.name, v)
+		}
+		*n.dst = f
+	}
+
+	if v := field("cooldown"); v != "" {
+		cooldown, err := strconv.Atoi(v)
+		if err != nil {
+			return s, fmt.Errorf("invalid cooldown %q", v)
+		}
+		s.Cooldown = cooldown
+	}
+
+	if v := field("active"); v != "" {
+		active, err := strconv.ParseBool(v)
+		if err != nil {
+			return s, fmt.Errorf("invalid active %q", v)
+		}
+		s.Active = active
+	}
+
+	return s, nil
 }
 
-func (s *sub) getSubByToken(db *sql.DB) error {
-	return db.QueryRow("SELECT token, percent, minval, maxval, minmaxchange, active FROM subs WHERE token=$1",
-		s.Token).Scan(&s.Token, &s.Percent, &s.MinVal, &s.MaxVal, &s.MinMaxChange, &s.Active)
+// normalize puts the token and quote symbols in canonical form
+func (s *sub) normalize() {
+	s.Token = normalizeToken(s.Token)
+	s.Quote = normalizeToken(s.Quote)
+	if s.Quote == "" {
+		s.Quote = defaultQuote
+	}
+	s.Condition = strings.TrimSpace(s.Condition)
+	s.Window = strings.ToLower(strings.TrimSpace(s.Window))
 }
 
-func (s *sub) getSub(db *sql.DB) error {
-	return db.QueryRow("SELECT token, percent, minval, maxval, minmaxchange, active FROM subs WHERE id=$1",
-		s.ID).Scan(&s.Token, &s.Percent, &s.MinVal, &s.MaxVal, &s.MinMaxChange, &s.Active)
+// normalizeToken returns the canonical, upper case form of a token symbol.
+func normalizeToken(token string) string {
+	return strings.ToUpper(strings.TrimSpace(token))
 }
 
-func (s *sub) updateSub(db *sql.DB) error {
-	_, err :=
-		db.Exec("UPDATE subs SET token=$1, percent=$2, minval=$3, maxval=$4, minmaxchange=$5, active=$6 WHERE id=$7",
-			s.Token, s.Percent, s.MinVal, s.MaxVal, s.MinMaxChange, s.Active, s.ID)
+// getSubsByTokens returns all of owner's subscriptions to any of tokens.
+func getSubsByTokens(db dbtx, owner string, tokens []string) ([]sub, error) {
+	rows, err := db.Query(
+		"SELECT "+subColumns+" FROM subs WHERE owner=$1 AND UPPER(token)=ANY($2) ORDER BY token, quote, id",
+		owner, pq.Array(tokens))
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close()
+
+	subs := []sub{}
 
-	return err
+	for rows.Next() {
+		var s sub
+		if err := scanSub(rows, &s); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+
+	return subs, rows.Err()
+}
+
+// getSub loads the subscription with s.ID owned by s.Owner
+func (s *sub) getSub(db dbtx) error {
+	return scanSub(db.QueryRow("SELECT "+subColumns+" FROM subs WHERE id=$1 AND owner=$2", s.ID, s.Owner), s)
+}
+
+// updateSub saves the subscription with s.ID owned by s.Owner. It returns
+// sql.ErrNoRows if there is none.
+func (s *sub) updateSub(db dbtx) error {
+	s.normalize()
+	res, err :=
+		db.Exec("UPDATE subs SET token=$1, quote=$2, percent=$3, lookback=$4, minval=$5, maxval=$6, minmaxchange=$7, condition=$8, cooldown=$9, active=$10 WHERE id=$11 AND owner=$12",
+			s.Token, s.Quote, s.Percent, s.Window, s.MinVal, s.MaxVal, s.MinMaxChange, s.Condition, s.Cooldown, s.Active, s.ID, s.Owner)
+
+	return affectedOne(res, err)
 }
 
-func (s *sub) deleteSub(db *sql.DB) error {
-	_, err :=
-		db.Exec("DELETE FROM subs WHERE id=$1", s.ID)
+// deleteSub deletes the subscription with s.ID owned by s.Owner. It returns
+// sql.ErrNoRows if there is none.
+func (s *sub) deleteSub(db dbtx) error {
+	res, err := db.Exec("DELETE FROM subs WHERE id=$1 AND owner=$2", s.ID, s.Owner)
+
+	return affectedOne(res, err)
+}
+
+// affectedOne turns a statement that changed no row into sql.ErrNoRows
+func affectedOne(res sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return sql.ErrNoRows
+	}
 
-	return err
+	return nil
 }
 
-func (s *sub) createSub(db *sql.DB) error {
+func (s *sub) createSub(db dbtx) error {
+	s.normalize()
 	err := db.QueryRow(
-		"INSERT INTO subs(token, percent, minval, maxval, minmaxchange) VALUES($1, $2, $3, $4, $5) RETURNING id",
-		s.Token, s.Percent, s.MinVal, s.MaxVal, s.MinMaxChange).Scan(&s.ID)
+		"INSERT INTO subs(token, quote, percent, lookback, minval, maxval, minmaxchange, condition, cooldown, active, owner) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11) RETURNING id",
+		s.Token, s.Quote, s.Percent, s.Window, s.MinVal, s.MaxVal, s.MinMaxChange, s.Condition, s.Cooldown, s.Active, s.Owner).Scan(&s.ID)
 
 	if err != nil {
 		return err
@@ -51,13 +265,178 @@ func (s *sub) createSub(db *sql.DB) error {
 	return nil
 }
 
-func getAllSubs(db *sql.DB, start, count int) ([]sub, error) {
-	rows, err := db.Query(
-		"SELECT id, token, percent, minval, maxval, minmaxchange, active FROM subs LIMIT $1 OFFSET $2",
-		count, start)
+// subSortColumns maps the sort keys accepted by the API to their column and
+// the type the cursor value has to be cast to when comparing.
+var subSortColumns = map[string][2]string{
+	"id":           {"id", "integer"},
+	"token":        {"token", "text"},
+	"quote":        {"quote", "text"},
+	"percent":      {"percent", "numeric"},
+	"minVal":       {"minval", "numeric"},
+	"maxVal":       {"maxval", "numeric"},
+	"minMaxChange": {"minmaxchange", "numeric"},
+}
 
+// subCursor marks the last row of a page: the value of the sort column and
+// the id used to break ties. Sort is the sort key of the listing, such as
+// "-token", as the value only makes sense for that key.
+type subCursor struct {
+	Sort  string `json:"s"`
+	Value string `json:"v"`
+	ID    int    `json:"id"`
+}
+
+func (c subCursor) encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeSubCursor(s string) (*subCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
 	if err != nil {
-		return nil, err
+		return nil, errors.New("invalid cursor")
+	}
+
+	var c subCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, errors.New("invalid cursor")
+	}
+
+	return &c, nil
+}
+
+// subRange is an optional inclusive range filter on a numeric column.
+type subRange struct {
+	Gte *float64
+	Lte *float64
+}
+
+// subQuery describes a filtered, sorted page of subscriptions. Queries are
+// scoped to Owner unless AllOwners is set, which only the watcher does.
+type subQuery struct {
+	Owner        string
+	AllOwners    bool
+	Token        string
+	Quote        string
+	Active       *bool
+	Percent      subRange
+	MinVal       subRange
+	MaxVal       subRange
+	MinMaxChange subRange
+	Sort         string
+	Desc         bool
+	After        *subCursor
+	Count        int
+}
+
+// sortKey returns the sort of q as accepted by the API, e.g. "-token"
+func (q subQuery) sortKey() string {
+	key := q.Sort
+	if key == "" {
+		key = "id"
+	}
+	if q.Desc {
+		return "-" + key
+	}
+	return key
+}
+
+// where builds the filter clause shared by the page and count queries,
+// appending its parameters to args.
+func (q subQuery) where(args []interface{}) (string, []interface{}) {
+	conds := []string{}
+	add := func(cond string, v interface{}) {
+		args = append(args, v)
+		conds = append(conds, fmt.Sprintf(cond, len(args)))
+	}
+
+	if !q.AllOwners {
+		add("owner=$%d", q.Owner)
+	}
+	if q.Token != "" {
+		add("token=$%d", q.Token)
+	}
+	if q.Quote != "" {
+		add("quote=$%d", q.Quote)
+	}
+	if q.Active != nil {
+		add("COALESCE(active, FALSE)=$%d", *q.Active)
+	}
+
+	ranges := []struct {
+		column string
+		r      subRange
+	}{
+		{"percent", q.Percent},
+		{"minval", q.MinVal},
+		{"maxval", q.MaxVal},
+		{"minmaxchange", q.MinMaxChange},
+	}
+	for _, f := range ranges {
+		if f.r.Gte != nil {
+			add(f.column+">=$%d", *f.r.Gte)
+		}
+		if f.r.Lte != nil {
+			add(f.column+"<=$%d", *f.r.Lte)
+		}
+	}
+
+	if len(conds) == 0 {
+		return "", args
+	}
+
+	return " WHERE " + strings.Join(conds, " AND "), args
+}
+
+// countSubs returns the number of subscriptions matching the filters of q,
+// ignoring its cursor and page size.
+func countSubs(db dbtx, q subQuery) (int, error) {
+	where, args := q.where(nil)
+
+	var total int
+	err := db.QueryRow("SELECT COUNT(*) FROM subs"+where, args...).Scan(&total)
+
+	return total, err
+}
+
+// listSubs returns a page of subscriptions matching q using keyset
+// pagination, along with the cursor of the next page ("" on the last page).
+func listSubs(db dbtx, q subQuery) ([]sub, string, error) {
+	if q.Sort == "" {
+		q.Sort = "id"
+	}
+	sortColumn, ok := subSortColumns[q.Sort]
+	if !ok {
+		return nil, "", fmt.Errorf("cannot sort by %q", q.Sort)
+	}
+	column, cast := sortColumn[0], sortColumn[1]
+
+	where, args := q.where(nil)
+
+	dir, cmp := "ASC", ">"
+	if q.Desc {
+		dir, cmp = "DESC", "<"
+	}
+
+	if q.After != nil {
+		args = append(args, q.After.Value, q.After.ID)
+		keyset := fmt.Sprintf("(%s, id) %s ($%d::%s, $%d)", column, cmp, len(args)-1, cast, len(args))
+		if where == "" {
+			where = " WHERE " + keyset
+		} else {
+			where += " AND " + keyset
+		}
+	}
+
+	// fetch one extra row to find out whether there is a next page
+	args = append(args, q.Count+1)
+	query := fmt.Sprintf(
+		"SELECT %s FROM subs%s ORDER BY %s %s, id %s LIMIT $%d",
+		subColumns, where, column, dir, dir, len(args))
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, "", err
 	}
 
 	defer rows.Close()
@@ -66,11 +445,74 @@ func getAllSubs(db *sql.DB, start, count int) ([]sub, error) {
 
 	for rows.Next() {
 		var s sub
-		if err := rows.Scan(&s.ID, &s.Token, &s.Percent, &s.MinVal, &s.MaxVal, &s.MinMaxChange, &s.Active); err != nil {
-			return nil, err
+		if err := scanSub(rows, &s); err != nil {
+			return nil, "", err
 		}
 		subs = append(subs, s)
 	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+
+	if len(subs) <= q.Count {
+		return subs, "", nil
+	}
+
+	subs = subs[:q.Count]
+	last := subs[len(subs)-1]
+
+	return subs, subCursor{Sort: q.sortKey(), Value: last.sortValue(q.Sort), ID: last.ID}.encode(), nil
+}
+
+// sortValue returns the value of the given sort key as stored in a cursor.
+func (s *sub) sortValue(key string) string {
+	switch key {
+	case "token":
+		return s.Token
+	case "quote":
+		return s.Quote
+	case "percent":
+		return strconv.FormatFloat(s.Percent, 'f', -1, 64)
+	case "minVal":
+		return strconv.FormatFloat(s.MinVal, 'f', -1, 64)
+	case "maxVal":
+		return strconv.FormatFloat(s.MaxVal, 'f', -1, 64)
+	case "minMaxChange":
+		return strconv.FormatFloat(s.MinMaxChange, 'f', -1, 64)
+	default:
+		return strconv.Itoa(s.ID)
+	}
+}
+
+// collectSubs returns every subscription matching q, paging through
+// listSubs.
+func collectSubs(db dbtx, q subQuery) ([]sub, error) {
+	q.Count = 100
+	subs := []sub{}
+
+	for {
+		page, next, err := listSubs(db, q)
+		if err != nil {
+			return nil, err
+		}
+		subs = append(subs, page...)
+
+		if next == "" {
+			return subs, nil
+		}
+		if q.After, err = decodeSubCursor(next); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// getSubsByOwner returns every subscription of owner
+func getSubsByOwner(db dbtx, owner string) ([]sub, error) {
+	return collectSubs(db, subQuery{Owner: owner})
+}
 
-	return subs, nil
+// getActiveSubs returns the subscriptions the watcher has to evaluate
+func getActiveSubs(db dbtx) ([]sub, error) {
+	active := true
+	return collectSubs(db, subQuery{AllOwners: true, Active: &active})
 }
@@ -0,0 +1,130 @@
+package main_test
+
+import (
+	"bytes"
+	"crypto-go/main"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeCertPair writes a self-signed certificate for name and its key to
+// certFile and keyFile, dated modTime, and returns the DER of the certificate
+func writeCertPair(t *testing.T, certFile, keyFile, name string, modTime time.Time) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for path, block := range map[string]*pem.Block{
+		certFile: {Type: "CERTIFICATE", Bytes: der},
+		keyFile:  {Type: "EC PRIVATE KEY", Bytes: keyDER},
+	} {
+		if err := os.WriteFile(path, pem.EncodeToMemory(block), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return der
+}
+
+// Test that a rewritten certificate is served once its files are checked,
+// and that a broken pair keeps the current one
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	start := time.Now().Add(-time.Hour)
+
+	first := writeCertPair(t, certFile, keyFile, "old.example.com", start)
+	c, err := main.NewCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	served := func() []byte {
+		cert, err := c.GetCertificate(nil)
+		if err != nil || cert == nil {
+			t.Fatalf("Expected a certificate. Got '%v'", err)
+		}
+		return cert.Certificate[0]
+	}
+
+	if !bytes.Equal(served(), first) {
+		t.Fatal("Expected the certificate loaded at start to be served")
+	}
+
+	second := writeCertPair(t, certFile, keyFile, "new.example.com", start.Add(time.Minute))
+	if !bytes.Equal(served(), first) {
+		t.Error("Expected the old certificate to be served until the files are checked")
+	}
+	c.CheckFiles()
+	if !bytes.Equal(served(), second) {
+		t.Error("Expected the rewritten certificate to be served")
+	}
+
+	os.WriteFile(keyFile, []byte("not a key"), 0600)
+	os.Chtimes(keyFile, start.Add(2*time.Minute), start.Add(2*time.Minute))
+	c.CheckFiles()
+	if !bytes.Equal(served(), second) {
+		t.Error("Expected a broken pair to keep the current certificate")
+	}
+}
+
+// Test that plain HTTP requests are redirected to the same path and query
+// over HTTPS
+func TestRedirectToHTTPS(t *testing.T) {
+	cases := []struct {
+		method   string
+		host     string
+		tlsPort  string
+		target   string
+		code     int
+		location string
+	}{
+		{"GET", "example.com", "443", "/prices/ETH?quote=EUR&window=24h", http.StatusMovedPermanently, "https://example.com/prices/ETH?quote=EUR&window=24h"},
+		{"HEAD", "example.com:8080", "8443", "/docs", http.StatusMovedPermanently, "https://example.com:8443/docs"},
+		{"POST", "example.com:80", "443", "/subscriptions?dryRun=true", http.StatusPermanentRedirect, "https://example.com/subscriptions?dryRun=true"},
+		{"PUT", "[::1]:8080", "8443", "/users/me", http.StatusPermanentRedirect, "https://[::1]:8443/users/me"},
+		{"GET", "example.com", "443", "/a%2Fb?q=%20x", http.StatusMovedPermanently, "https://example.com/a%2Fb?q=%20x"},
+	}
+
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "http://"+c.host+c.target, nil)
+		rr := httptest.NewRecorder()
+		main.RedirectToHTTPS(c.tlsPort).ServeHTTP(rr, req)
+
+		if rr.Code != c.code || rr.Header().Get("Location") != c.location {
+			t.Errorf("Expected %s %s to redirect with %d to %s. Got %d to %s",
+				c.method, c.target, c.code, c.location, rr.Code, rr.Header().Get("Location"))
+		}
+	}
+}
@@ -1,28 +1,123 @@
 package main
 
 import (
-	"database/sql"
 	"errors"
+	"fmt"
+	"net/mail"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
 
 type user struct {
-	ID       int    `json:"id"`
-	Email    string `json:"email"`
-	Password string `json:"password,omitempty"`
+	ID         int    `json:"id"`
+	Email      string `json:"email"`
+	Password   string `json:"password,omitempty"`
+	Number     string `json:"number,omitempty"`
+	Timezone   string `json:"timezone,omitempty"`
+	QuietStart string `json:"quietStart,omitempty"`
+	QuietEnd   string `json:"quietEnd,omitempty"`
+	Digest     string `json:"digest,omitempty"`
 }
 
-func (u *user) getUserByID(db *sql.DB) error {
+// defaultTimezone is used for users who have not set one
+const defaultTimezone = "UTC"
+
+// hasNumber reports whether the user registered a phone number for SMS
+func (u *user) hasNumber() bool {
+	return u.Number != "" && u.Number != "0"
+}
+
+func (u *user) getUserByID(db dbtx) error {
 	return errors.New("Not implemented")
 }
 
-func (u *user) getUserByEmail(db *sql.DB) error {
-	return db.QueryRow("SELECT email, password FROM users WHERE email=$1",
-		u.Email).Scan(&u.Email, &u.Password)
+func (u *user) getUserByEmail(db dbtx) error {
+	return db.QueryRow("SELECT id, email, password, COALESCE(number, ''), timezone, quiet_start, quiet_end, digest FROM users WHERE email=$1",
+		u.Email).Scan(&u.ID, &u.Email, &u.Password, &u.Number, &u.Timezone, &u.QuietStart, &u.QuietEnd, &u.Digest)
+}
+
+// updateProfile stores the notification settings of the user
+func (u *user) updateProfile(db dbtx) error {
+	res, err :=
+		db.Exec("UPDATE users SET number=$1, timezone=$2, quiet_start=$3, quiet_end=$4, digest=$5 WHERE email=$6",
+			u.Number, u.Timezone, u.QuietStart, u.QuietEnd, u.Digest, u.Email)
+
+	return affectedOne(res, err)
+}
+
+// validateProfile checks the timezone, quiet hours and digest mode of the user
+func (u *user) validateProfile() error {
+	if u.Timezone == "" {
+		u.Timezone = defaultTimezone
+	}
+	if _, err := time.LoadLocation(u.Timezone); err != nil {
+		return fmt.Errorf("unknown timezone %q", u.Timezone)
+	}
+
+	if (u.QuietStart == "") != (u.QuietEnd == "") {
+		return errors.New("quietStart and quietEnd must be set together")
+	}
+	for _, v := range []string{u.QuietStart, u.QuietEnd} {
+		if _, err := clockMinutes(v); v != "" && err != nil {
+			return err
+		}
+	}
+
+	if _, ok := digestIntervals[u.Digest]; u.Digest != "" && !ok {
+		return fmt.Errorf("invalid digest %q, use hourly or daily", u.Digest)
+	}
+
+	return nil
+}
+
+// inQuietHours reports whether t falls in the user's quiet hours, in their
+// timezone. Quiet hours may span midnight, e.g. 22:00 to 07:00.
+func (u *user) inQuietHours(t time.Time) bool {
+	start, err1 := clockMinutes(u.QuietStart)
+	end, err2 := clockMinutes(u.QuietEnd)
+	if err1 != nil || err2 != nil || start == end {
+		return false
+	}
+
+	local := t.In(u.location())
+	now := local.Hour()*60 + local.Minute()
+
+	if start < end {
+		return now >= start && now < end
+	}
+	return now >= start || now < end
+}
+
+// location returns the user's timezone, UTC if it is not valid
+func (u *user) location() *time.Location {
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// clockMinutes parses a "15:04" time of day into minutes after midnight
+func clockMinutes(v string) (int, error) {
+	t, err := time.Parse("15:04", v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q, use HH:MM", v)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// validateEmail checks that the user registers with a plain address such as
+// "me@example.com"
+func (u *user) validateEmail() error {
+	addr, err := mail.ParseAddress(u.Email)
+	if err != nil || addr.Address != u.Email {
+		return fmt.Errorf("invalid email %q", u.Email)
+	}
+	return nil
 }
 
-func (u *user) createUser(db *sql.DB) error {
+func (u *user) createUser(db dbtx) error {
 	// call get user by email to see if email already taken
 	err := u.getUserByEmail(db)
 	if err == nil {
@@ -47,7 +142,7 @@ func (u *user) createUser(db *sql.DB) error {
 	return nil
 }
 
-func (u *user) comparePasswords(db *sql.DB) (int, error) {
+func (u *user) comparePasswords(db dbtx) (int, error) {
 	inputPassword := []byte(u.Password)
 	u.Password = ""
 	err := u.getUserByEmail(db)
@@ -58,7 +153,7 @@ func (u *user) comparePasswords(db *sql.DB) (int, error) {
 	return 0, bcrypt.CompareHashAndPassword([]byte(u.Password), inputPassword)
 }
 
-func getAllUsers(db *sql.DB) ([]user, error) {
+func getAllUsers(db dbtx) ([]user, error) {
 	rows, err := db.Query("SELECT id, email FROM users")
 
 	if err != nil {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
 	"net/http"
 	"time"
@@ -33,7 +34,7 @@ func (a *App) loginUser(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	if statusCode, err := u.comparePasswords(a.DB); err != nil {
+	if statusCode, err := u.comparePasswords(a.store(r)); err != nil {
 		switch statusCode {
 		case 400:
 			respondWithError(w, http.StatusBadRequest, "No User exists for this email")
@@ -59,9 +60,33 @@ func (a *App) loginUser(w http.ResponseWriter, r *http.Request) {
 	w.Write(payload)
 }
 
+// POST a fresh token for the authenticated user, so clients can stay logged
+// in without sending the password again. Tokens of deleted users are not
+// renewed.
+func (a *App) refreshToken(w http.ResponseWriter, r *http.Request) {
+	u := user{Email: userEmail(r)}
+	if err := u.getUserByEmail(a.store(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusUnauthorized, "User not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	tokenStr, err := createToken(u.Email)
+	if err != nil {
+		respondWithError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	respondWithJSON(w, http.StatusOK, map[string]string{"email": u.Email, "token": tokenStr})
+}
+
 // GET all users
 func (a *App) getAllUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := getAllUsers(a.DB)
+	users, err := getAllUsers(a.store(r))
 	if err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 	}
@@ -78,7 +103,12 @@ func (a *App) createUser(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	if err := u.createUser(a.DB); err != nil {
+	if err := u.validateEmail(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if err := u.createUser(a.store(r)); err != nil {
 		respondWithError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -86,23 +116,63 @@ func (a *App) createUser(w http.ResponseWriter, r *http.Request) {
 	respondWithJSON(w, http.StatusCreated, u)
 }
 
-// GET user by email
-func (a *App) getUserByEmail(w http.ResponseWriter, r *http.Request) {
-	var u user
+// GET the profile of the authenticated user
+func (a *App) getProfile(w http.ResponseWriter, r *http.Request) {
+	u := user{Email: userEmail(r)}
+	if err := u.getUserByEmail(a.store(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "User not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	u.Password = ""
+
+	respondWithJSON(w, http.StatusOK, u)
+}
+
+// PUT the phone number, timezone, quiet hours and digest mode of the
+// authenticated user. Fields missing from the body keep their stored values.
+func (a *App) updateProfile(w http.ResponseWriter, r *http.Request) {
+	u := user{Email: userEmail(r)}
+	if err := u.getUserByEmail(a.store(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "User not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	id, email := u.ID, u.Email
+
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&u); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+		respondWithError(w, http.StatusBadRequest, "Invalid Request Payload")
 		return
 	}
-
 	defer r.Body.Close()
 
-	if err := u.getUserByEmail(a.DB); err != nil {
-		respondWithError(w, http.StatusInternalServerError, err.Error())
+	u.ID, u.Email = id, email
+	u.Password = ""
+
+	if err := u.validateProfile(); err != nil {
+		respondWithError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
-	u.Password = ""
+	if err := u.updateProfile(a.store(r)); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			respondWithError(w, http.StatusNotFound, "User not found")
+		default:
+			respondWithError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
 
-	respondWithJSON(w, http.StatusOK, u)
+	a.getProfile(w, r)
 }
@@ -0,0 +1,59 @@
+package main_test
+
+import (
+	"crypto-go/main"
+	"testing"
+	"time"
+)
+
+// Test quiet hours spanning midnight and in timezones other than UTC
+func TestInQuietHours(t *testing.T) {
+	at := func(v string) time.Time {
+		ts, _ := time.Parse(time.RFC3339, v)
+		return ts
+	}
+
+	cases := []struct {
+		timezone   string
+		start, end string
+		t          string
+		expected   bool
+	}{
+		// spanning midnight
+		{"UTC", "22:00", "07:00", "2024-01-15T21:59:00Z", false},
+		{"UTC", "22:00", "07:00", "2024-01-15T22:00:00Z", true},
+		{"UTC", "22:00", "07:00", "2024-01-15T23:30:00Z", true},
+		{"UTC", "22:00", "07:00", "2024-01-16T00:00:00Z", true},
+		{"UTC", "22:00", "07:00", "2024-01-16T06:59:00Z", true},
+		{"UTC", "22:00", "07:00", "2024-01-16T07:00:00Z", false},
+		{"UTC", "22:00", "07:00", "2024-01-16T12:00:00Z", false},
+
+		// within a day
+		{"UTC", "09:00", "17:00", "2024-01-15T08:59:00Z", false},
+		{"UTC", "09:00", "17:00", "2024-01-15T12:00:00Z", true},
+		{"UTC", "09:00", "17:00", "2024-01-15T17:00:00Z", false},
+
+		// in the user's timezone, across daylight saving time
+		{"Europe/Berlin", "22:00", "07:00", "2024-01-15T21:30:00Z", true},
+		{"Europe/Berlin", "22:00", "07:00", "2024-07-01T20:30:00Z", true},
+		{"Europe/Berlin", "22:00", "07:00", "2024-01-15T05:30:00Z", true},
+		{"Europe/Berlin", "22:00", "07:00", "2024-07-01T05:30:00Z", false},
+		{"America/New_York", "09:00", "17:00", "2024-01-15T14:00:00Z", true},
+		{"America/New_York", "09:00", "17:00", "2024-01-15T22:00:00Z", false},
+		{"Asia/Kolkata", "22:00", "07:00", "2024-01-15T01:00:00Z", true},
+		{"Asia/Kolkata", "22:00", "07:00", "2024-01-15T01:30:00Z", false},
+
+		// an unknown timezone falls back to UTC
+		{"Mars/Olympus", "22:00", "07:00", "2024-01-15T23:00:00Z", true},
+
+		// no quiet hours
+		{"UTC", "", "", "2024-01-15T23:00:00Z", false},
+		{"UTC", "22:00", "22:00", "2024-01-15T22:00:00Z", false},
+	}
+
+	for _, c := range cases {
+		if got := main.InQuietHours(c.timezone, c.start, c.end, at(c.t)); got != c.expected {
+			t.Errorf("Expected %s in %s from %s to %s to be %v. Got %v", c.t, c.timezone, c.start, c.end, c.expected, got)
+		}
+	}
+}
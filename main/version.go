@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// the unversioned routes are deprecated aliases of /v1 since
+// legacyDeprecated and will be removed at legacySunset
+var (
+	legacyDeprecated = time.Date(2026, time.October, 19, 0, 0, 0, 0, time.UTC)
+	legacySunset     = time.Date(2027, time.April, 30, 0, 0, 0, 0, time.UTC)
+)
+
+// deprecatedRoute marks the responses of an unversioned route with the
+// Deprecation (RFC 9745) and Sunset (RFC 8594) headers
+func deprecatedRoute(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, r *http.Request) {
+		h := w.Header()
+		h.Set("Deprecation", "@"+strconv.FormatInt(legacyDeprecated.Unix(), 10))
+		h.Set("Sunset", legacySunset.Format(http.TimeFormat))
+
+		next.ServeHTTP(w, r)
+	}
+
+	return http.HandlerFunc(fn)
+}
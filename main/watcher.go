@@ -0,0 +1,549 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// watcher polls the price source, evaluates the active subscriptions and
+// queues notifications for their owners.
+type watcher struct {
+	db       *sql.DB
+	source   priceSource
+	notifier notifier
+	hub      *hub
+	metrics  *metrics
+	logger   *slog.Logger
+
+	// baselines holds the price each subscription is compared against
+	baselines map[int]float64
+
+	// conditions holds the last result of each subscription's condition,
+	// which only fires when it turns true
+	conditions map[int]bool
+
+	// windows holds whether each windowed percent change was last over its
+	// threshold, so it fires once per excursion
+	windows map[int]bool
+
+	// dailyLimits caps the messages per owner, channel and day
+	dailyLimits map[string]int
+	dedupWindow time.Duration
+
+	rawRetention time.Duration
+	maxRetention time.Duration
+	lastPrune    time.Time
+
+	interval time.Duration
+	// lastRound is when the last polling round succeeded, in unix nanoseconds
+	lastRound atomic.Int64
+}
+
+// pruneInterval is how often old price samples are downsampled
+const pruneInterval = time.Hour
+
+func newWatcher(db *sql.DB, source priceSource, n notifier, h *hub, m *metrics, cfg config) *watcher {
+	return &watcher{
+		db:           db,
+		source:       source,
+		notifier:     n,
+		hub:          h,
+		metrics:      m,
+		logger:       slog.Default().With("component", "watcher"),
+		baselines:    map[int]float64{},
+		conditions:   map[int]bool{},
+		windows:      map[int]bool{},
+		dailyLimits:  cfg.DailyLimits,
+		dedupWindow:  cfg.DedupWindow.Duration,
+		rawRetention: cfg.PriceRetention.Duration,
+		maxRetention: cfg.PriceHistory.Duration,
+		interval:     cfg.PollInterval.Duration,
+	}
+}
+
+// run checks prices every poll interval until ctx is done
+func (w *watcher) run(ctx context.Context) {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.check(ctx); err != nil {
+			w.logger.Error("checking prices", "error", err)
+		} else {
+			w.lastRound.Store(time.Now().UnixNano())
+		}
+		if err := w.flushDeferred(ctx); err != nil {
+			w.logger.Error("flushing deferred notifications", "error", err)
+		}
+
+		if time.Since(w.lastPrune) >= pruneInterval {
+			w.prune(ctx)
+			w.lastPrune = time.Now()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// prune deletes the history, feed entries, deliveries and counters that are
+// no longer needed
+func (w *watcher) prune(ctx context.Context) {
+	ctx, span := startSpan(ctx, "watcher.prune")
+	defer span.End()
+	db := withContext(ctx, w.db)
+
+	if err := prunePrices(db, w.rawRetention, w.maxRetention); err != nil {
+		w.logger.Error("pruning prices", "error", err)
+	}
+	if err := pruneUserEvents(db, feedRetention); err != nil {
+		w.logger.Error("pruning user events", "error", err)
+	}
+	if err := pruneDeliveries(db, feedRetention); err != nil {
+		w.logger.Error("pruning deliveries", "error", err)
+	}
+	// keep yesterday in every timezone
+	if err := pruneNotificationCounts(db, time.Now().AddDate(0, 0, -2).Format("2006-01-02")); err != nil {
+		w.logger.Error("pruning notification counts", "error", err)
+	}
+}
+
+// lastSuccess returns when the last polling round succeeded, or the zero
+// time if none has
+func (w *watcher) lastSuccess() time.Time {
+	if n := w.lastRound.Load(); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
+
+// check runs a single polling round
+func (w *watcher) check(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "watcher.check")
+	defer func() { endSpan(span, err) }()
+
+	db := withContext(ctx, w.db)
+
+	subs, err := getActiveSubs(db)
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.Int("subscriptions", len(subs)))
+
+	conds := map[int]*condition{}
+	for i := range subs {
+		if subs[i].Condition == "" {
+			continue
+		}
+		c, err := parseCondition(subs[i].Condition)
+		if err != nil {
+			w.logger.Warn("invalid condition", "subscription", subs[i].ID, "error", err)
+			continue
+		}
+		conds[subs[i].ID] = c
+	}
+
+	tokens, quotes := subPairs(subs, conds)
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	fetchCtx, fetch := startSpan(ctx, "prices "+w.source.Name(), attribute.StringSlice("tokens", tokens), attribute.StringSlice("quotes", quotes))
+	start := time.Now()
+	book, err := w.source.Prices(fetchCtx, withPivots(tokens), quotes)
+	w.metrics.observeFetch(w.source.Name(), time.Since(start), err)
+	endSpan(fetch, err)
+	if err != nil {
+		return err
+	}
+
+	points := w.samples(book, tokens, quotes)
+	if err := insertPrices(db, points); err != nil {
+		w.logger.Error("recording prices", "error", err)
+	}
+	for _, p := range points {
+		w.hub.publishTick(p.Token, p.Quote, p.Price, p.Time)
+	}
+
+	env := roundEnv{db: db, book: book, now: time.Now()}
+
+	seen := map[int]bool{}
+	for i := range subs {
+		s := &subs[i]
+		seen[s.ID] = true
+
+		price, ok := book.rate(s.Token, s.Quote)
+
+		if c := conds[s.ID]; c != nil {
+			w.checkCondition(ctx, s, c, env, price)
+		}
+
+		if s.Percent == 0 && s.MinVal == 0 && s.MaxVal == 0 {
+			continue
+		}
+
+		if !ok {
+			w.logger.Warn("no price", "source", w.source.Name(), "pair", pricePair(s.Token, s.Quote))
+			continue
+		}
+
+		if s.Window != "" {
+			w.checkWindow(ctx, s, price, env.now)
+		}
+
+		baseline, ok := w.baselines[s.ID]
+		if !ok {
+			w.baselines[s.ID] = price
+			continue
+		}
+
+		rule := s.evaluate(price, baseline)
+		if rule == "" {
+			// keep the percent baseline, but follow the price for crossings
+			if s.Percent == 0 || s.Window != "" {
+				w.baselines[s.ID] = price
+			}
+			continue
+		}
+
+		w.baselines[s.ID] = price
+		w.fire(ctx, s, rule, price, baseline)
+	}
+
+	for id := range w.baselines {
+		if !seen[id] {
+			delete(w.baselines, id)
+		}
+	}
+	for id := range w.conditions {
+		if !seen[id] {
+			delete(w.conditions, id)
+		}
+	}
+	for id := range w.windows {
+		if !seen[id] {
+			delete(w.windows, id)
+		}
+	}
+
+	return nil
+}
+
+// checkCondition evaluates the condition of s and fires when it turns true.
+// A condition that cannot be evaluated (missing prices or history) keeps
+// its previous state.
+func (w *watcher) checkCondition(ctx context.Context, s *sub, c *condition, env condEnv, price float64) {
+	met, err := c.eval(env, s.Quote)
+	if err != nil {
+		w.logger.Warn("evaluating condition", "subscription", s.ID, "error", err)
+		return
+	}
+
+	was := w.conditions[s.ID]
+	w.conditions[s.ID] = met
+	if met && !was {
+		w.fire(ctx, s, ruleCond, price, 0)
+	}
+}
+
+// checkWindow fires when the change of the price over the subscription's
+// rolling window reaches its percent threshold. Without a stored price near
+// the start of the window the check is skipped and keeps its state.
+func (w *watcher) checkWindow(ctx context.Context, s *sub, price float64, now time.Time) {
+	window := lookbackWindows[s.Window]
+
+	then, err := priceAt(withContext(ctx, w.db), s.Token, s.Quote, now.Add(-window), historyTolerance(window))
+	if err != nil {
+		if err != errNoHistory {
+			w.logger.Error("reading price history", "subscription", s.ID, "error", err)
+		}
+		return
+	}
+
+	over := math.Abs(percentChange(then, price)) >= s.Percent
+	was := w.windows[s.ID]
+	w.windows[s.ID] = over
+	if over && !was {
+		w.fire(ctx, s, rulePercent, price, then)
+	}
+}
+
+// samples converts a polling round into rows of the price history: every
+// pair the source quoted, plus the cross rates derived for the others.
+func (w *watcher) samples(book quoteBook, tokens, quotes []string) []pricePoint {
+	now := time.Now()
+	points := []pricePoint{}
+
+	for _, token := range tokens {
+		for _, quote := range quotes {
+			if token == quote {
+				continue
+			}
+
+			p := pricePoint{Token: token, Quote: quote, Source: w.source.Name(), Time: now}
+			if t, ok := book[token][quote]; ok && t.Price > 0 {
+				p.Price, p.Volume = t.Price, t.Volume
+			} else if price, ok := book.rate(token, quote); ok {
+				p.Price = price
+				p.Source += "-cross"
+			} else {
+				continue
+			}
+			points = append(points, p)
+		}
+	}
+
+	return points
+}
+
+// fire records an alert event for s and queues its notification. Nothing is
+// recorded while s is cooling down or when the same alert was just recorded.
+func (w *watcher) fire(ctx context.Context, s *sub, rule string, price, baseline float64) {
+	e := alertEvent{
+		SubID:     s.ID,
+		Owner:     s.Owner,
+		Token:     s.Token,
+		Quote:     s.Quote,
+		Rule:      rule,
+		Price:     price,
+		Baseline:  baseline,
+		Threshold: s.threshold(rule),
+		Message:   s.message(rule, price, baseline),
+		Channel:   w.notifier.Channel(),
+	}
+
+	db := withContext(ctx, w.db)
+
+	cooling, err := s.inCooldown(db, time.Now())
+	if err != nil {
+		w.logger.Error("checking cooldown", "subscription", s.ID, "error", err)
+	}
+	if cooling {
+		w.logger.Info("alert suppressed by cooldown", "subscription", s.ID, "rule", rule)
+		return
+	}
+
+	duplicate, err := e.isDuplicate(db, w.dedupWindow)
+	if err != nil {
+		w.logger.Error("checking duplicates", "subscription", s.ID, "error", err)
+	}
+	if duplicate {
+		w.logger.Info("duplicate alert dropped", "subscription", s.ID, "rule", rule)
+		return
+	}
+
+	if err := w.record(db, &e); err != nil {
+		w.logger.Error("recording alert", "subscription", s.ID, "error", err)
+		return
+	}
+	w.metrics.alertFired(rule)
+
+	w.hub.publishEvent(&e)
+	publishUserEvent(db, w.hub, e.Owner, feedAlert, &e)
+}
+
+// record stores the event together with the outbox entry of its
+// notification in one transaction. Events of owners in quiet hours or with
+// a digest mode are deferred instead.
+func (w *watcher) record(db database, e *alertEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	u := user{Email: e.Owner}
+	if err := u.getUserByEmail(db); err != nil {
+		e.Status, e.Error = deliveryFailed, fmt.Sprintf("owner %q: %v", e.Owner, err)
+	} else if !u.hasNumber() {
+		e.Status, e.Error = deliverySkipped, "owner has no phone number"
+	} else if u.Digest != "" || u.inQuietHours(time.Now()) {
+		e.Status = deliveryDeferred
+	} else if e.Status, e.Error, err = w.reserve(tx, &u); err != nil {
+		return err
+	}
+
+	if err := e.createEvent(tx); err != nil {
+		return err
+	}
+
+	if e.Status == deliveryPending {
+		d := delivery{EventIDs: []int64{e.ID}, Owner: u.Email, Channel: e.Channel, Recipient: u.Number, Message: e.Message}
+		if err := d.enqueue(tx); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// reserve counts a message to u against the daily limit of the channel. It
+// returns deliveryPending, or deliveryLimited once the limit is reached.
+func (w *watcher) reserve(db dbtx, u *user) (string, string, error) {
+	channel := w.notifier.Channel()
+	limit, ok := w.dailyLimits[channel]
+	if !ok {
+		return deliveryPending, "", nil
+	}
+
+	reserved, err := reserveNotification(db, u.Email, channel, u.localDay(time.Now()), limit)
+	if err != nil {
+		return "", "", err
+	}
+	if !reserved {
+		return deliveryLimited, fmt.Sprintf("daily %s limit of %d reached", channel, limit), nil
+	}
+
+	return deliveryPending, "", nil
+}
+
+// flushDeferred queues the alerts held back during quiet hours or for a
+// digest as a single message per owner, once the owner's quiet hours are
+// over and the oldest alert is as old as the digest interval.
+func (w *watcher) flushDeferred(ctx context.Context) (err error) {
+	ctx, span := startSpan(ctx, "watcher.flushDeferred")
+	defer func() { endSpan(span, err) }()
+	db := withContext(ctx, w.db)
+
+	events, err := getEventsByStatus(db, deliveryDeferred)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for start := 0; start < len(events); {
+		end := start + 1
+		for end < len(events) && events[end].Owner == events[start].Owner {
+			end++
+		}
+		batch := events[start:end]
+		start = end
+
+		u := user{Email: batch[0].Owner}
+		if err := u.getUserByEmail(db); err != nil {
+			w.logger.Error("loading owner", "user", u.Email, "error", err)
+			continue
+		}
+		if u.inQuietHours(now) {
+			continue
+		}
+		if now.Sub(batch[0].CreatedAt) < digestIntervals[u.Digest] {
+			continue
+		}
+
+		if err := w.recordDigest(db, &u, batch); err != nil {
+			w.logger.Error("recording digest", "user", u.Email, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// recordDigest queues one message for a batch of deferred events and
+// updates their status in the same transaction
+func (w *watcher) recordDigest(db database, u *user, batch []alertEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	status, errText := deliverySkipped, "owner has no phone number"
+	if u.hasNumber() {
+		if status, errText, err = w.reserve(tx, u); err != nil {
+			return err
+		}
+	}
+
+	ids := make([]int64, len(batch))
+	for i := range batch {
+		batch[i].Status, batch[i].Error = status, errText
+		if err := batch[i].updateDelivery(tx); err != nil {
+			return err
+		}
+		ids[i] = batch[i].ID
+	}
+
+	if status == deliveryPending {
+		d := delivery{EventIDs: ids, Owner: u.Email, Channel: w.notifier.Channel(), Recipient: u.Number, Message: digestMessage(u, batch)}
+		if err := d.enqueue(tx); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// digestMessage combines the messages of several alerts to u into one
+func digestMessage(u *user, events []alertEvent) string {
+	if len(events) == 1 {
+		return events[0].Message
+	}
+
+	lines := []string{fmt.Sprintf("%d alerts since %s:", len(events), events[0].CreatedAt.In(u.location()).Format("Jan 2 15:04 MST"))}
+	for _, e := range events {
+		lines = append(lines, "- "+e.Message)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// subPairs returns the distinct tokens of subs and their conditions, and the
+// quotes to request for them, including the pivots used for cross rates.
+func subPairs(subs []sub, conds map[int]*condition) ([]string, []string) {
+	if len(subs) == 0 {
+		return nil, nil
+	}
+
+	tokenSet := map[string]bool{}
+	quoteSet := map[string]bool{}
+	for _, q := range pivotQuotes {
+		quoteSet[q] = true
+	}
+	for _, s := range subs {
+		tokenSet[s.Token] = true
+		quoteSet[s.Quote] = true
+
+		if c := conds[s.ID]; c != nil {
+			for _, p := range c.symbols(s.Quote) {
+				tokenSet[p.Token] = true
+				quoteSet[p.Quote] = true
+			}
+		}
+	}
+
+	return sortedKeys(tokenSet), sortedKeys(quoteSet)
+}
+
+// withPivots adds the pivot currencies to tokens so that every pivot can be
+// converted into every quote.
+func withPivots(tokens []string) []string {
+	set := map[string]bool{}
+	for _, t := range tokens {
+		set[t] = true
+	}
+	for _, q := range pivotQuotes {
+		set[q] = true
+	}
+	return sortedKeys(set)
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
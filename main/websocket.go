@@ -0,0 +1,142 @@
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// time allowed to write a message to the peer
+	wsWriteWait = 10 * time.Second
+
+	// time allowed to read the next pong from the peer
+	wsPongWait = 60 * time.Second
+
+	// pings are sent with this period, which must be less than wsPongWait
+	wsPingPeriod = wsPongWait * 9 / 10
+
+	// largest message accepted from the peer
+	wsMaxMessageSize = 4096
+
+	// messages queued for a client before it is considered too slow
+	wsSendQueue = 64
+)
+
+var upgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+}
+
+// wsOriginAllowed reports whether a browser on the request's origin may open
+// a WebSocket. Browsers do not apply CORS to WebSockets, so the origins
+// allowed by the CORS config are checked here; requests without an Origin
+// (non-browser clients) and same-origin requests are always accepted.
+func (a *App) wsOriginAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	return a.CORS.allowsOrigin(origin)
+}
+
+// wsRequest is a message sent by a client to change the ticks it receives
+type wsRequest struct {
+	Action string   `json:"action"`
+	Tokens []string `json:"tokens"`
+}
+
+// GET /ws upgrades to a WebSocket streaming price ticks for the tokens the
+// client subscribes to and the caller's alert events. Browsers cannot set
+// headers on WebSocket requests, so the token may be passed as ?token=.
+func (a *App) serveWS(w http.ResponseWriter, r *http.Request) {
+	email, ok := authenticateStream(w, r)
+	if !ok {
+		return
+	}
+
+	u := upgrader
+	u.CheckOrigin = a.wsOriginAllowed
+	conn, err := u.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already replied to the client
+		return
+	}
+
+	c := newHubClient(email, false, wsSendQueue)
+	a.hub.register(c)
+
+	go a.wsWritePump(conn, c)
+	a.wsReadPump(conn, c)
+}
+
+// wsReadPump handles subscribe/unsubscribe requests until the connection
+// fails or the client is dropped
+func (a *App) wsReadPump(conn *websocket.Conn, c *hubClient) {
+	defer func() {
+		a.hub.unregister(c)
+		conn.Close()
+	}()
+
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		var req wsRequest
+		if err := conn.ReadJSON(&req); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				slog.Warn("websocket read failed", "component", "ws", "user", c.owner, "error", err)
+			}
+			return
+		}
+
+		switch req.Action {
+		case "subscribe":
+			a.hub.subscribe(c, req.Tokens, true)
+		case "unsubscribe":
+			a.hub.subscribe(c, req.Tokens, false)
+		}
+	}
+}
+
+// wsWritePump writes queued messages and heartbeats to the connection
+func (a *App) wsWritePump(conn *websocket.Conn, c *hubClient) {
+	ticker := time.NewTicker(wsPingPeriod)
+	defer func() {
+		ticker.Stop()
+		conn.Close()
+	}()
+
+	for {
+		select {
+		case f := <-c.send:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.TextMessage, f.data); err != nil {
+				return
+			}
+		case <-ticker.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		case <-c.done:
+			if c.reason != "" {
+				conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+				conn.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, c.reason))
+			}
+			return
+		}
+	}
+}